@@ -0,0 +1,161 @@
+package access
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnel-transporter/util"
+)
+
+var (
+	// Control filters public connections by remote ip on the server, nil when not configured.
+	Control *AccessControl
+)
+
+// Networks accepts CIDR notations and single IPv4 or IPv6 addresses.
+type Networks []*net.IPNet
+
+func (n *Networks) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var values []string
+	if err := unmarshal(&values); err != nil {
+		return err
+	}
+
+	networks := Networks{}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return errors.New(fmt.Sprintf("invalid ip address %q", value))
+			}
+
+			if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, network)
+	}
+
+	*n = networks
+	return nil
+}
+
+func (n Networks) Contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Rules struct {
+	Allow Networks
+	Deny  Networks
+}
+
+type rulesFile struct {
+	Rules  `yaml:",inline"`
+	Agents map[string]struct {
+		Tunnels map[string]Rules
+	}
+}
+
+// AccessControl holds the global and per tunnel allow and deny lists loaded from a yaml file,
+// which is reloaded whenever the file changes without touching the running tunnels.
+type AccessControl struct {
+	path string
+
+	lock    sync.RWMutex
+	global  Rules
+	tunnels map[string]map[string]Rules
+
+	denied uint64
+}
+
+func NewAccessControl(path string) (*AccessControl, error) {
+	control := &AccessControl{path: path}
+	if err := control.load(); err != nil {
+		return nil, err
+	}
+
+	return control, nil
+}
+
+func (c *AccessControl) load() error {
+	bytes, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	file := rulesFile{}
+	if err = yaml.Unmarshal(bytes, &file); err != nil {
+		return err
+	}
+
+	tunnels := map[string]map[string]Rules{}
+	for agentId, agent := range file.Agents {
+		tunnels[agentId] = agent.Tunnels
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.global = file.Rules
+	c.tunnels = tunnels
+	return nil
+}
+
+func (c *AccessControl) Watch(interval time.Duration) {
+	util.WatchFile(c.path, interval, c.load)
+}
+
+// Allows checks the remote ip of a public connection to the tunnel. A matching deny entry, global
+// or of the tunnel, always denies. Otherwise the allow list of the tunnel decides, or the global
+// one when the tunnel has none, and an empty allow list allows every ip.
+func (c *AccessControl) Allows(agentId string, tunnelName string, ip net.IP) bool {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+
+	c.lock.RLock()
+	tunnel := c.tunnels[agentId][tunnelName]
+	global := c.global
+	c.lock.RUnlock()
+
+	allowed := true
+	switch {
+	case global.Deny.Contains(ip) || tunnel.Deny.Contains(ip):
+		allowed = false
+	case len(tunnel.Allow) != 0:
+		allowed = tunnel.Allow.Contains(ip)
+	case len(global.Allow) != 0:
+		allowed = global.Allow.Contains(ip)
+	}
+
+	if !allowed {
+		atomic.AddUint64(&c.denied, 1)
+	}
+
+	return allowed
+}
+
+// Denied returns the number of denied attempts since the server started.
+func (c *AccessControl) Denied() uint64 {
+	return atomic.LoadUint64(&c.denied)
+}
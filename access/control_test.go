@@ -0,0 +1,110 @@
+package access
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessControl(t *testing.T) {
+	directory, err := ioutil.TempDir("", "access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "access.yaml")
+	content := `
+allow: [10.0.0.0/8, "2001:db8::/32"]
+deny: [10.0.0.1]
+agents:
+  ABC:
+    tunnels:
+      web:
+        allow: [192.168.1.0/24]
+        deny: [192.168.1.1]
+`
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	control, err := NewAccessControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		tunnel  string
+		ip      string
+		allowed bool
+	}{
+		{"ssh", "10.1.2.3", true},
+		{"ssh", "::ffff:10.1.2.3", true},
+		{"ssh", "10.0.0.1", false},
+		{"ssh", "172.16.0.1", false},
+		{"ssh", "2001:db8::1", true},
+		{"ssh", "2001:db9::1", false},
+		{"web", "192.168.1.2", true},
+		{"web", "192.168.1.1", false},
+		{"web", "10.1.2.3", false},
+		{"web", "10.0.0.1", false},
+	}
+
+	for _, c := range cases {
+		if allowed := control.Allows("ABC", c.tunnel, net.ParseIP(c.ip)); allowed != c.allowed {
+			t.Errorf("expected %s on tunnel %s allowed %t, got %t", c.ip, c.tunnel, c.allowed, allowed)
+		}
+	}
+
+	if control.Denied() != 6 {
+		t.Fatalf("expected 6 denied attempts, got %d", control.Denied())
+	}
+}
+
+func TestAccessControlReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.yaml")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write("deny: [127.0.0.1]\n", now.Add(-time.Minute))
+	control, err := NewAccessControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go control.Watch(10 * time.Millisecond)
+	// let the watcher take the modification time of the first rules
+	time.Sleep(100 * time.Millisecond)
+
+	if control.Allows("ABC", "web", net.ParseIP("127.0.0.1")) || !control.Allows("ABC", "web", net.ParseIP("10.1.2.3")) {
+		t.Fatal("expected only the denied source to be denied")
+	}
+
+	waitFor := func(allowed bool, description string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for control.Allows("ABC", "web", net.ParseIP("127.0.0.1")) != allowed {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", description)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	write("deny: [10.0.0.0/8]\n", now)
+	waitFor(true, "the reloaded rules to allow the source")
+
+	write("deny: [not an ip]\n", now.Add(time.Minute))
+	time.Sleep(100 * time.Millisecond)
+	if !control.Allows("ABC", "web", net.ParseIP("127.0.0.1")) || control.Allows("ABC", "web", net.ParseIP("10.1.2.3")) {
+		t.Fatal("expected invalid rules to keep the running ones")
+	}
+}
@@ -0,0 +1,123 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	JsonFormat     = "json"
+	TemplateFormat = "template"
+
+	ClientClosed = "client_closed"
+	AgentClosed  = "agent_closed"
+	AgentFailed  = "agent_failed"
+	Timeout      = "timeout"
+	Denied       = "denied"
+	AdminClosed  = "admin_closed"
+	Shutdown     = "shutdown"
+)
+
+var (
+	// Log records public connections on the server, nil when not configured.
+	Log *AccessLog
+)
+
+// Record describes a public connection once it is closed. BytesUp were sent by the client
+// towards the local service, BytesDown were sent back to it.
+type Record struct {
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"-"`
+	RemoteAddr string        `json:"remote_addr"`
+	AgentId    string        `json:"agent_id"`
+	Tunnel     string        `json:"tunnel"`
+	TunnelType string        `json:"tunnel_type"`
+	BytesUp    uint64        `json:"bytes_up"`
+	BytesDown  uint64        `json:"bytes_down"`
+	Reason     string        `json:"reason"`
+	Error      string        `json:"error,omitempty"`
+}
+
+type jsonRecord struct {
+	Record
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// AccessLog appends a line per record to a dedicated file, either as json or rendered by a
+// text/template over Record.
+type AccessLog struct {
+	lock     sync.Mutex
+	file     *os.File
+	template *template.Template
+}
+
+func NewAccessLog(path string, format string, text string) (*AccessLog, error) {
+	accessLog := &AccessLog{}
+
+	switch format {
+	case "", JsonFormat:
+	case TemplateFormat:
+		if text == "" {
+			return nil, errors.New("template access log format requires not blank template")
+		}
+
+		parsed, err := template.New("access-log").Parse(strings.TrimSuffix(text, "\n"))
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing access log template")
+		}
+		accessLog.template = parsed
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported access log format %s, expecting json or template", format))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	accessLog.file = file
+
+	return accessLog, nil
+}
+
+func (a *AccessLog) Write(record Record) {
+	buffer := &bytes.Buffer{}
+	if a.template != nil {
+		if err := a.template.Execute(buffer, record); err != nil {
+			log.WithError(err).Error("error rendering access log record")
+			return
+		}
+		buffer.WriteByte('\n')
+	} else {
+		if err := json.NewEncoder(buffer).Encode(jsonRecord{Record: record, DurationMs: record.Duration.Milliseconds()}); err != nil {
+			log.WithError(err).Error("error encoding access log record")
+			return
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, err := a.file.Write(buffer.Bytes()); err != nil {
+		log.WithError(err).Error("error writing access log")
+	}
+}
+
+func (a *AccessLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.file.Close()
+}
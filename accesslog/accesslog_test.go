@@ -0,0 +1,73 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var record = Record{
+	Start:      time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC),
+	Duration:   1500 * time.Millisecond,
+	RemoteAddr: "10.0.0.1:51000",
+	AgentId:    "ABC",
+	Tunnel:     "echo",
+	TunnelType: "tcp",
+	BytesUp:    10,
+	BytesDown:  20,
+	Reason:     ClientClosed,
+}
+
+func TestJsonFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := NewAccessLog(path, JsonFormat, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessLog.Write(record)
+	accessLog.Close()
+
+	content, _ := ioutil.ReadFile(path)
+	var written map[string]interface{}
+	if err = json.Unmarshal(content, &written); err != nil {
+		t.Fatalf("expected a json line, got %q", content)
+	}
+
+	if written["remote_addr"] != "10.0.0.1:51000" || written["duration_ms"] != float64(1500) || written["reason"] != ClientClosed {
+		t.Fatalf("unexpected record %v", written)
+	}
+
+	if _, ok := written["error"]; ok {
+		t.Fatalf("expected no error field, got %v", written)
+	}
+}
+
+func TestTemplateFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := NewAccessLog(path, TemplateFormat, "{{.RemoteAddr}} {{.AgentId}}/{{.Tunnel}} {{.BytesUp}} {{.BytesDown}} {{.Duration}} {{.Reason}}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessLog.Write(record)
+	accessLog.Write(record)
+	accessLog.Close()
+
+	content, _ := ioutil.ReadFile(path)
+	line := "10.0.0.1:51000 ABC/echo 10 20 1.5s client_closed\n"
+	if string(content) != line+line {
+		t.Fatalf("unexpected content %q", content)
+	}
+}
+
+func TestInvalidFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	if _, err := NewAccessLog(path, "xml", ""); err == nil {
+		t.Fatal("expected unsupported format error")
+	}
+
+	if _, err := NewAccessLog(path, TemplateFormat, "{{.RemoteAddr"); err == nil {
+		t.Fatal("expected template parse error")
+	}
+}
@@ -0,0 +1,276 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/proxy"
+	"tunnel-transporter/registry"
+)
+
+const apiPrefix = "/api/agents"
+
+type Agent struct {
+	Id             string
+	Version        string
+	OS             string
+	Arch           string
+	RemoteAddr     string
+	Multiplex      bool
+	ConnectedSince time.Time
+	Metadata       map[string]string
+	BytesIn        uint64
+	BytesOut       uint64
+	Tunnels        []Tunnel
+}
+
+type Tunnel struct {
+	AgentId            string
+	Name               string
+	Type               constants.TunnelType
+	PublicPort         uint16
+	Hosts              []string
+	ActiveConnections  int
+	DeniedConnections  uint64
+	RefusedConnections uint64
+	BytesIn            uint64
+	BytesOut           uint64
+	Connections        []proxy.PublicConnection `json:",omitempty"`
+}
+
+type errorResponse struct {
+	Error string
+}
+
+// Server exposes the live proxies of the registry over a http api, every request must carry
+// the token as bearer authorization.
+//
+//	GET    /api/agents                                          list agents and their tunnels
+//	GET    /api/agents/{agent}                                  fetch an agent
+//	DELETE /api/agents/{agent}                                  disconnect an agent
+//	DELETE /api/agents/{agent}/reservations                     release the ports reserved for a disconnected agent
+//	GET    /api/agents/{agent}/tunnels/{tunnel}                 fetch a tunnel and its public connections
+//	DELETE /api/agents/{agent}/tunnels/{tunnel}/connections/{id} close a public connection
+type Server struct {
+	registry *registry.Manager
+	token    string
+}
+
+func NewServer(manager *registry.Manager, token string) *Server {
+	return &Server{registry: manager, token: token}
+}
+
+// Serve exposes the api on the given port.
+func (s *Server) Serve(port int) {
+	log.WithField("port", port).Info("exposing admin api")
+	if err := http.ListenAndServe(":"+strconv.Itoa(port), s.Handler()); err != nil {
+		log.WithField("port", port).WithError(err).Error("error serving admin api")
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc(apiPrefix, s.handle)
+	serveMux.HandleFunc(apiPrefix+"/", s.handle)
+	return serveMux
+}
+
+func (s *Server) authorized(request *http.Request) bool {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) handle(writer http.ResponseWriter, request *http.Request) {
+	if !s.authorized(request) {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(writer, http.StatusUnauthorized, errors.New("missing or invalid token"))
+		return
+	}
+
+	segments, err := pathSegments(request.URL)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case len(segments) == 0 && request.Method == http.MethodGet:
+		s.listAgents(writer)
+	case len(segments) == 1 && request.Method == http.MethodGet:
+		s.getAgent(writer, segments[0])
+	case len(segments) == 1 && request.Method == http.MethodDelete:
+		s.disconnectAgent(writer, segments[0])
+	case len(segments) == 2 && segments[1] == "reservations" && request.Method == http.MethodDelete:
+		s.removeReservations(writer, segments[0])
+	case len(segments) == 3 && segments[1] == "tunnels" && request.Method == http.MethodGet:
+		s.getTunnel(writer, segments[0], segments[2])
+	case len(segments) == 5 && segments[1] == "tunnels" && segments[3] == "connections" && request.Method == http.MethodDelete:
+		s.closeConnection(writer, segments[0], segments[2], segments[4])
+	default:
+		writeError(writer, http.StatusNotFound, errors.New("no such endpoint"))
+	}
+}
+
+func (s *Server) listAgents(writer http.ResponseWriter) {
+	writeJson(writer, http.StatusOK, Agents(s.registry))
+}
+
+// Agents returns the agents of the registry and their tunnels, ordered by agent id.
+func Agents(manager *registry.Manager) []Agent {
+	proxies := manager.Proxies()
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].AgentId < proxies[j].AgentId
+	})
+
+	agents := make([]Agent, 0, len(proxies))
+	for _, tunnelProxy := range proxies {
+		agents = append(agents, newAgent(tunnelProxy))
+	}
+
+	return agents
+}
+
+func (s *Server) getAgent(writer http.ResponseWriter, agentId string) {
+	tunnelProxy := s.registry.GetByAgentId(agentId)
+	if tunnelProxy == nil {
+		writeError(writer, http.StatusNotFound, errors.New("no such agent"))
+		return
+	}
+
+	writeJson(writer, http.StatusOK, newAgent(tunnelProxy))
+}
+
+func (s *Server) disconnectAgent(writer http.ResponseWriter, agentId string) {
+	tunnelProxy := s.registry.GetByAgentId(agentId)
+	if tunnelProxy == nil {
+		writeError(writer, http.StatusNotFound, errors.New("no such agent"))
+		return
+	}
+
+	log.WithField(constants.AgentIdField, agentId).Warn("disconnecting agent on admin request")
+	tunnelProxy.Close(errors.New("disconnected by admin api"))
+	s.registry.Remove(tunnelProxy)
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) removeReservations(writer http.ResponseWriter, agentId string) {
+	removed := s.registry.Reservations.Remove(agentId)
+	if removed == 0 {
+		writeError(writer, http.StatusNotFound, errors.New("no released port reservation"))
+		return
+	}
+
+	log.WithFields(log.Fields{constants.AgentIdField: agentId, "reservations": removed}).Info("removed port reservations on admin request")
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getTunnel(writer http.ResponseWriter, agentId string, tunnelName string) {
+	tunnel := s.registry.GetTunnel(agentId, tunnelName)
+	if tunnel == nil {
+		writeError(writer, http.StatusNotFound, errors.New("no such tunnel"))
+		return
+	}
+
+	view := newTunnel(tunnel)
+	view.Connections = tunnel.Connections()
+	writeJson(writer, http.StatusOK, view)
+}
+
+func (s *Server) closeConnection(writer http.ResponseWriter, agentId string, tunnelName string, connectionId string) {
+	tunnel := s.registry.GetTunnel(agentId, tunnelName)
+	if tunnel == nil {
+		writeError(writer, http.StatusNotFound, errors.New("no such tunnel"))
+		return
+	}
+
+	if !tunnel.CloseConnection(connectionId) {
+		writeError(writer, http.StatusNotFound, errors.New("no such connection"))
+		return
+	}
+
+	log.WithFields(log.Fields{constants.AgentIdField: agentId, constants.TunnelField: tunnelName, constants.ConnIdField: connectionId}).Info("closed public connection on admin request")
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func newAgent(tunnelProxy *proxy.Proxy) Agent {
+	agent := Agent{
+		Id:             tunnelProxy.AgentId,
+		Version:        tunnelProxy.AgentVersion,
+		OS:             tunnelProxy.OS,
+		Arch:           tunnelProxy.Arch,
+		RemoteAddr:     tunnelProxy.RemoteAddr,
+		Multiplex:      tunnelProxy.Multiplex,
+		ConnectedSince: tunnelProxy.ConnectedSince,
+		Metadata:       tunnelProxy.Metadata,
+		Tunnels:        []Tunnel{},
+	}
+
+	for _, tunnel := range tunnelProxy.Tunnels {
+		view := newTunnel(tunnel)
+		agent.BytesIn += view.BytesIn
+		agent.BytesOut += view.BytesOut
+		agent.Tunnels = append(agent.Tunnels, view)
+	}
+	sort.Slice(agent.Tunnels, func(i, j int) bool {
+		return agent.Tunnels[i].Name < agent.Tunnels[j].Name
+	})
+
+	return agent
+}
+
+func newTunnel(tunnel *proxy.Tunnel) Tunnel {
+	bytesIn, bytesOut := tunnel.Bytes()
+
+	return Tunnel{
+		AgentId:            tunnel.AgentId,
+		Name:               tunnel.Name,
+		Type:               tunnel.Type,
+		PublicPort:         tunnel.PublicListenPort,
+		Hosts:              tunnel.Hosts,
+		ActiveConnections:  tunnel.ActiveConnections(),
+		DeniedConnections:  tunnel.DeniedConnections(),
+		RefusedConnections: tunnel.RefusedConnections(),
+		BytesIn:            bytesIn,
+		BytesOut:           bytesOut,
+	}
+}
+
+// pathSegments splits the path below the api prefix into its unescaped segments.
+func pathSegments(requestUrl *url.URL) ([]string, error) {
+	path := strings.Trim(strings.TrimPrefix(requestUrl.EscapedPath(), apiPrefix), "/")
+	if path == "" {
+		return nil, nil
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = unescaped
+	}
+
+	return segments, nil
+}
+
+func writeJson(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		log.WithError(err).Error("error writing admin api response")
+	}
+}
+
+func writeError(writer http.ResponseWriter, status int, err error) {
+	writeJson(writer, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/proxy"
+	"tunnel-transporter/registry"
+)
+
+func TestServer(t *testing.T) {
+	manager := registry.NewRegistryManager()
+	manager.Put(&proxy.Proxy{
+		AgentId:      "ABC",
+		AgentVersion: "1.0",
+		Tunnels: map[string]*proxy.Tunnel{
+			"echo": {AgentId: "ABC", Name: "echo", Type: constants.TCP, PublicListenPort: 15000},
+		},
+	})
+
+	server := httptest.NewServer(NewServer(manager, "secret").Handler())
+	defer server.Close()
+
+	get := func(path string, token string) *http.Response {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	if response := get("/api/agents", "wrong"); response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized, got %d", response.StatusCode)
+	}
+
+	var agents []Agent
+	_ = json.NewDecoder(get("/api/agents", "secret").Body).Decode(&agents)
+	if len(agents) != 1 || agents[0].Id != "ABC" || len(agents[0].Tunnels) != 1 || agents[0].Tunnels[0].PublicPort != 15000 {
+		t.Fatalf("unexpected agents %+v", agents)
+	}
+
+	var tunnel Tunnel
+	_ = json.NewDecoder(get("/api/agents/ABC/tunnels/echo", "secret").Body).Decode(&tunnel)
+	if tunnel.Name != "echo" || tunnel.Type != constants.TCP {
+		t.Fatalf("unexpected tunnel %+v", tunnel)
+	}
+
+	if response := get("/api/agents/ABC/tunnels/other", "secret"); response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown tunnel not to be found, got %d", response.StatusCode)
+	}
+
+	request, _ := http.NewRequest(http.MethodDelete, server.URL+"/api/agents/ABC/tunnels/echo/connections/unknown", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown connection not to be found, got %d", response.StatusCode)
+	}
+
+	request, _ = http.NewRequest(http.MethodDelete, server.URL+"/api/agents/ABC/reservations", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected agent without released reservation not to be found, got %d", response.StatusCode)
+	}
+}
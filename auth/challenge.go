@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+	"tunnel-transporter/util"
+)
+
+var (
+	ErrInvalidProof = errors.New("invalid proof")
+	ErrExpiredProof = errors.New("proof timestamp outside of replay window")
+	ErrMissingKey   = errors.New("missing key")
+)
+
+// NewNonce returns the random challenge the server sends first on every agent connection.
+func NewNonce() string {
+	return util.RandomId()
+}
+
+// Sign proves the knowledge of key without sending it, as HMAC-SHA256(key, nonce + agentId + timestamp).
+func Sign(key string, nonce string, agentId string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(agentId))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a proof created by Sign, and that its timestamp lies within window of now.
+// The nonce is only issued once per connection, so a proof can not be replayed on another one.
+func Verify(key string, nonce string, agentId string, timestamp int64, proof string, window time.Duration) error {
+	if key == "" {
+		return ErrMissingKey
+	}
+
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew > window || skew < -window {
+		return errors.Wrap(ErrExpiredProof, fmt.Sprintf("clock skew %s", skew.Round(time.Second)))
+	}
+
+	expected := Sign(key, nonce, agentId, timestamp)
+	if !hmac.Equal([]byte(expected), []byte(proof)) {
+		return ErrInvalidProof
+	}
+
+	return nil
+}
+
+// SessionKey derives the key proving data connections of one bootstrap session from the
+// shared token, the bootstrap nonce and the session nonce issued in the bootstrap response.
+func SessionKey(token string, bootstrapNonce string, sessionNonce string) string {
+	return Sign(token, bootstrapNonce, sessionNonce, 0)
+}
+
+// Identity is what the server learned authenticating the bootstrap connection of an agent.
+type Identity struct {
+	AgentId string
+	Nonce   string
+
+	// Token is the token the agent proved, it keys the session of data connections
+	// and is empty when no token authentication is used.
+	Token  string
+	Claims *Claims
+
+	// Metadata is attached by the auth webhook.
+	Metadata map[string]string
+}
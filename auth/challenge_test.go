@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	nonce := NewNonce()
+	now := time.Now().Unix()
+	proof := Sign("token", nonce, "ABC", now)
+
+	if err := Verify("token", nonce, "ABC", now, proof, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify("other", nonce, "ABC", now, proof, time.Minute); err != ErrInvalidProof {
+		t.Fatalf("expected invalid proof with wrong key, got %v", err)
+	}
+
+	if err := Verify("token", NewNonce(), "ABC", now, proof, time.Minute); err != ErrInvalidProof {
+		t.Fatalf("expected invalid proof with other nonce, got %v", err)
+	}
+
+	if err := Verify("token", nonce, "XYZ", now, proof, time.Minute); err != ErrInvalidProof {
+		t.Fatalf("expected invalid proof with other agent id, got %v", err)
+	}
+
+	past := now - 120
+	if err := Verify("token", nonce, "ABC", past, Sign("token", nonce, "ABC", past), time.Minute); err == nil {
+		t.Fatal("expected error with timestamp outside of replay window")
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	if SessionKey("token", "A", "B") != SessionKey("token", "A", "B") {
+		t.Fatal("expected same session key from same nonces")
+	}
+
+	if SessionKey("token", "A", "B") == SessionKey("token", "A", "C") {
+		t.Fatal("expected different session key from different session nonce")
+	}
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+	"tunnel-transporter/config"
+	"tunnel-transporter/config/server"
+	"tunnel-transporter/util"
+)
+
+var (
+	// Credentials is the per-agent credentials store of the server, nil when not configured.
+	Credentials *CredentialsStore
+)
+
+type Credential struct {
+	Token          string
+	Expires        time.Time
+	Disabled       bool
+	AllowedTunnels []string          `yaml:"allowed-tunnels"`
+	AllowedPorts   server.PortRanges `yaml:"allowed-ports"`
+	AllowedDomains []string          `yaml:"allowed-domains"`
+}
+
+type credentialsFile struct {
+	Agents map[string]Credential
+}
+
+// CredentialsStore holds the credentials of every agent loaded from a yaml or json file,
+// which is reloaded whenever the file changes.
+type CredentialsStore struct {
+	path string
+
+	lock        sync.RWMutex
+	credentials map[string]Credential
+}
+
+func NewCredentialsStore(path string) (*CredentialsStore, error) {
+	store := &CredentialsStore{path: path}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *CredentialsStore) load() error {
+	bytes, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	file := credentialsFile{}
+	if err = yaml.Unmarshal(bytes, &file); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.credentials = file.Agents
+	return nil
+}
+
+// Watch reloads the store whenever the file is modified, a file failing to load keeps the
+// previous credentials.
+func (s *CredentialsStore) Watch(interval time.Duration) {
+	util.WatchFile(s.path, interval, s.load)
+}
+
+func (s *CredentialsStore) Get(agentId string) (Credential, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	credential, ok := s.credentials[agentId]
+	return credential, ok
+}
+
+// Check returns the credential of the agent, failing when it is unknown, disabled or expired.
+func (s *CredentialsStore) Check(agentId string) (Credential, error) {
+	credential, ok := s.Get(agentId)
+	if !ok {
+		return Credential{}, errors.New(fmt.Sprintf("unknown agent %s", agentId))
+	}
+
+	if credential.Disabled {
+		return Credential{}, errors.New(fmt.Sprintf("agent %s is disabled", agentId))
+	}
+
+	if !credential.Expires.IsZero() && time.Now().After(credential.Expires) {
+		return Credential{}, errors.New(fmt.Sprintf("credentials of agent %s expired at %s", agentId, credential.Expires.Format(time.RFC3339)))
+	}
+
+	return credential, nil
+}
+
+func (c Credential) AllowsTunnel(name string) bool {
+	if len(c.AllowedTunnels) == 0 {
+		return true
+	}
+
+	for _, allowedTunnel := range c.AllowedTunnels {
+		if allowedTunnel == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c Credential) AllowsPort(port uint16) bool {
+	return c.AllowedPorts.Contains(port)
+}
+
+// AllowsHost matches the host against the allowed domains, where "*.example.com" allows
+// every subdomain of example.com.
+func (c Credential) AllowsHost(host string) bool {
+	if len(c.AllowedDomains) == 0 {
+		return true
+	}
+
+	host = util.NormalizeHost(host)
+	for _, domain := range c.AllowedDomains {
+		domain = util.NormalizeHost(domain)
+		if strings.HasPrefix(domain, "*.") {
+			if strings.HasSuffix(host, domain[1:]) {
+				return true
+			}
+		} else if host == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AgentToken returns the token the agent authenticates with, its own one from the credentials
+// store when configured, the shared static token otherwise.
+func AgentToken(agentId string) string {
+	if Credentials != nil {
+		credential, _ := Credentials.Get(agentId)
+		return credential.Token
+	}
+
+	return config.Get().Server.Authentication.StaticToken.Token
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCredentialsStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "credentials.yaml")
+	content := `
+agents:
+  ABC:
+    token: secret
+    allowed-tunnels: [web]
+    allowed-ports: 10000-10100
+    allowed-domains: ["*.example.com"]
+  OLD:
+    token: secret
+    expires: 2000-01-01T00:00:00Z
+  OFF:
+    token: secret
+    disabled: true
+`
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewCredentialsStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := store.Check("ABC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if credential.Token != "secret" {
+		t.Fatalf("expected token secret, got %s", credential.Token)
+	}
+
+	if !credential.AllowsTunnel("web") || credential.AllowsTunnel("ssh") {
+		t.Fatal("expected only tunnel web to be allowed")
+	}
+
+	if !credential.AllowsPort(10000) || credential.AllowsPort(10101) {
+		t.Fatal("expected only ports 10000-10100 to be allowed")
+	}
+
+	if !credential.AllowsHost("web.example.com") || credential.AllowsHost("example.com") || credential.AllowsHost("web.example.org") {
+		t.Fatal("expected only subdomains of example.com to be allowed")
+	}
+
+	for _, agentId := range []string{"OLD", "OFF", "NEW"} {
+		if _, err = store.Check(agentId); err == nil {
+			t.Fatalf("expected agent %s to be rejected", agentId)
+		}
+	}
+}
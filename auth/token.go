@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+	"tunnel-transporter/config/server"
+)
+
+const (
+	HmacAlgorithm    = "hmac"
+	Ed25519Algorithm = "ed25519"
+)
+
+var (
+	// tokenKey holds the *SigningKey verifying the signed tokens of agents on the server.
+	tokenKey atomic.Value
+
+	ErrInvalidToken   = errors.New("invalid token")
+	ErrInvalidSigning = errors.New("invalid token signature")
+	ErrExpiredToken   = errors.New("token expired")
+)
+
+// TokenKey returns the key verifying the signed tokens of agents, nil when not configured.
+func TokenKey() *SigningKey {
+	key, _ := tokenKey.Load().(*SigningKey)
+	return key
+}
+
+// SetTokenKey replaces the key verifying signed tokens, handshakes in progress keep the previous one.
+func SetTokenKey(key *SigningKey) {
+	tokenKey.Store(key)
+}
+
+// Claims are the permissions carried by a signed token. Empty ports and subdomains and a
+// zero max tunnels do not restrict the agent.
+type Claims struct {
+	AgentId    string   `json:"sub"`
+	IssuedAt   int64    `json:"iat,omitempty"`
+	ExpiresAt  int64    `json:"exp,omitempty"`
+	Ports      string   `json:"ports,omitempty"`
+	Subdomains []string `json:"subdomains,omitempty"`
+	MaxTunnels int      `json:"max_tunnels,omitempty"`
+
+	portRanges server.PortRanges
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+}
+
+// SigningKey signs and verifies tokens in the compact JWT format, either with a HMAC-SHA256
+// secret or an Ed25519 key pair. An Ed25519 key verifying tokens only holds the public key.
+type SigningKey struct {
+	algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+func NewHmacKey(secret string) *SigningKey {
+	return &SigningKey{algorithm: HmacAlgorithm, secret: []byte(secret)}
+}
+
+// LoadEd25519PrivateKey loads a PKCS #8 PEM private key, e.g. from `openssl genpkey -algorithm ed25519`.
+func LoadEd25519PrivateKey(path string) (*SigningKey, error) {
+	block, err := readPem(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s is not an ed25519 private key", path))
+	}
+
+	return &SigningKey{
+		algorithm:  Ed25519Algorithm,
+		privateKey: privateKey,
+		publicKey:  privateKey.Public().(ed25519.PublicKey),
+	}, nil
+}
+
+// LoadEd25519PublicKey loads a PKIX PEM public key, e.g. from `openssl pkey -pubout`.
+func LoadEd25519PublicKey(path string) (*SigningKey, error) {
+	block, err := readPem(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s is not an ed25519 public key", path))
+	}
+
+	return &SigningKey{algorithm: Ed25519Algorithm, publicKey: publicKey}, nil
+}
+
+func readPem(path string) (*pem.Block, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("no pem data found in %s", path))
+	}
+
+	return block, nil
+}
+
+func (k *SigningKey) header() tokenHeader {
+	if k.algorithm == Ed25519Algorithm {
+		return tokenHeader{Algorithm: "EdDSA", Type: "JWT"}
+	}
+
+	return tokenHeader{Algorithm: "HS256", Type: "JWT"}
+}
+
+func (k *SigningKey) sign(content []byte) ([]byte, error) {
+	if k.algorithm == Ed25519Algorithm {
+		if k.privateKey == nil {
+			return nil, errors.New("missing ed25519 private key")
+		}
+		return ed25519.Sign(k.privateKey, content), nil
+	}
+
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(content)
+	return mac.Sum(nil), nil
+}
+
+func (k *SigningKey) verify(content []byte, signature []byte) bool {
+	if k.algorithm == Ed25519Algorithm {
+		return ed25519.Verify(k.publicKey, content, signature)
+	}
+
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(content)
+	return hmac.Equal(mac.Sum(nil), signature)
+}
+
+// Issue mints a token carrying the claims.
+func (k *SigningKey) Issue(claims Claims) (string, error) {
+	if claims.AgentId == "" {
+		return "", errors.New("token requires an agent id")
+	}
+
+	if _, err := server.ParsePortRanges(claims.Ports); err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(k.header())
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	content := encodeSegment(header) + "." + encodeSegment(payload)
+	signature, err := k.sign([]byte(content))
+	if err != nil {
+		return "", err
+	}
+
+	return content + "." + encodeSegment(signature), nil
+}
+
+// Verify checks the signature and the expiry of the token and returns its claims. The algorithm
+// of the token must match the key, so a token can not choose how it is verified.
+func (k *SigningKey) Verify(token string) (*Claims, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerBytes, err := decodeSegment(segments[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	header := tokenHeader{}
+	if err = json.Unmarshal(headerBytes, &header); err != nil || header != k.header() {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := decodeSegment(segments[2])
+	if err != nil || !k.verify([]byte(segments[0]+"."+segments[1]), signature) {
+		return nil, ErrInvalidSigning
+	}
+
+	payload, err := decodeSegment(segments[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	claims := &Claims{}
+	if err = json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	if claims.portRanges, err = server.ParsePortRanges(claims.Ports); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// Complete verifies the token presented by an agent like Verify and returns the whole token.
+// Hmac tokens are presented without their signature, the secret signs their content again.
+// Ed25519 tokens are presented whole, over the tls transport, as the public key can not sign.
+func (k *SigningKey) Complete(presented string) (string, *Claims, error) {
+	token := presented
+	if k.algorithm != Ed25519Algorithm {
+		signature, err := k.sign([]byte(presented))
+		if err != nil {
+			return "", nil, err
+		}
+		token = presented + "." + encodeSegment(signature)
+	}
+
+	claims, err := k.Verify(token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, claims, nil
+}
+
+// PresentToken returns what the agent sends of its token, see Complete, and whether the token
+// has to be sent whole.
+func PresentToken(token string) (presented string, whole bool) {
+	segments := strings.Split(token, ".")
+	if headerBytes, err := decodeSegment(segments[0]); err == nil {
+		header := tokenHeader{}
+		if json.Unmarshal(headerBytes, &header) == nil && header.Algorithm == "EdDSA" {
+			return token, true
+		}
+	}
+
+	content, _ := SplitToken(token)
+	return content, false
+}
+
+// SplitToken separates the content of a token, carrying its header and claims, from its
+// signature. The signature keys the proof of the possession of the token.
+func SplitToken(token string) (content string, signature string) {
+	index := strings.LastIndex(token, ".")
+	if index < 0 {
+		return token, ""
+	}
+
+	return token[:index], token[index+1:]
+}
+
+func encodeSegment(bytes []byte) string {
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(segment)
+}
+
+func (c *Claims) AllowsPort(port uint16) bool {
+	return c.portRanges.Contains(port)
+}
+
+func (c *Claims) AllowsSubdomain(subdomain string) bool {
+	if len(c.Subdomains) == 0 {
+		return true
+	}
+
+	for _, allowedSubdomain := range c.Subdomains {
+		if strings.EqualFold(allowedSubdomain, subdomain) {
+			return true
+		}
+	}
+
+	return false
+}
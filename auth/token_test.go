@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestHmacToken(t *testing.T) {
+	key := NewHmacKey("secret")
+	token, err := key.Issue(Claims{AgentId: "ABC", Ports: "10000-10100", Subdomains: []string{"web"}, MaxTunnels: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := key.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.AgentId != "ABC" || claims.MaxTunnels != 2 {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	if !claims.AllowsPort(10000) || claims.AllowsPort(20000) {
+		t.Fatal("expected only ports 10000-10100 to be allowed")
+	}
+
+	if !claims.AllowsSubdomain("WEB") || claims.AllowsSubdomain("api") {
+		t.Fatal("expected only subdomain web to be allowed")
+	}
+
+	if _, err = NewHmacKey("other").Verify(token); err != ErrInvalidSigning {
+		t.Fatalf("expected invalid signature with other secret, got %v", err)
+	}
+
+	expired, err := key.Issue(Claims{AgentId: "ABC", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = key.Verify(expired); err != ErrExpiredToken {
+		t.Fatalf("expected expired token, got %v", err)
+	}
+}
+
+func TestEd25519Token(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingKey := &SigningKey{algorithm: Ed25519Algorithm, privateKey: privateKey, publicKey: publicKey}
+	verifyingKey := &SigningKey{algorithm: Ed25519Algorithm, publicKey: publicKey}
+
+	token, err := signingKey.Issue(Claims{AgentId: "ABC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = verifyingKey.Verify(token); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = verifyingKey.Issue(Claims{AgentId: "ABC"}); err == nil {
+		t.Fatal("expected error issuing without private key")
+	}
+
+	hmacToken, err := NewHmacKey("secret").Issue(Claims{AgentId: "ABC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = verifyingKey.Verify(hmacToken); err != ErrInvalidToken {
+		t.Fatalf("expected hmac token to be rejected by ed25519 key, got %v", err)
+	}
+}
+
+func TestCompleteToken(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		signingKey   *SigningKey
+		verifyingKey *SigningKey
+		whole        bool
+	}{
+		{NewHmacKey("secret"), NewHmacKey("secret"), false},
+		{
+			&SigningKey{algorithm: Ed25519Algorithm, privateKey: privateKey, publicKey: publicKey},
+			&SigningKey{algorithm: Ed25519Algorithm, publicKey: publicKey},
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		token, err := c.signingKey.Issue(Claims{AgentId: "ABC"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		presented, whole := PresentToken(token)
+		if whole != c.whole || (presented == token) != c.whole {
+			t.Fatalf("expected %s token to be presented whole %t, got %s", c.signingKey.algorithm, c.whole, presented)
+		}
+
+		completed, claims, err := c.verifyingKey.Complete(presented)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if completed != token || claims.AgentId != "ABC" {
+			t.Fatalf("expected %s token completed to %s, got %s", c.signingKey.algorithm, token, completed)
+		}
+
+		_, signature := SplitToken(token)
+		nonce, timestamp := NewNonce(), time.Now().Unix()
+		proof := Sign(signature, nonce, "ABC", timestamp)
+		if err = Verify(signature, nonce, "ABC", timestamp, proof, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		content, _ := SplitToken(token)
+		if c.whole {
+			if _, _, err = c.verifyingKey.Complete(content); err != ErrInvalidToken {
+				t.Fatalf("expected ed25519 token without signature to be rejected, got %v", err)
+			}
+		}
+	}
+
+	forged, err := NewHmacKey("other").Issue(Claims{AgentId: "ABC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgedContent, forgedSignature := SplitToken(forged)
+	completed, _, err := NewHmacKey("secret").Complete(forgedContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, signature := SplitToken(completed)
+	nonce, timestamp := NewNonce(), time.Now().Unix()
+	if Verify(signature, nonce, "ABC", timestamp, Sign(forgedSignature, nonce, "ABC", timestamp), time.Minute) != ErrInvalidProof {
+		t.Fatal("expected proof of a token forged with another secret to be rejected")
+	}
+
+	if _, _, err = NewHmacKey("secret").Complete("invalid"); err != ErrInvalidToken {
+		t.Fatalf("expected invalid token, got %v", err)
+	}
+}
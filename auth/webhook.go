@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnel-transporter/message"
+)
+
+const (
+	LoginOperation         = "Login"
+	NewTunnelOperation     = "NewTunnel"
+	NewConnectionOperation = "NewConnection"
+
+	maxCachedResponses = 4096
+)
+
+var (
+	// webhook holds the *WebhookClient reviewing logins, tunnels and public connections on the server.
+	webhook atomic.Value
+
+	ErrDenied = errors.New("denied by auth webhook")
+)
+
+// Webhook returns the client reviewing logins, tunnels and public connections, nil when not configured.
+func Webhook() *WebhookClient {
+	client, _ := webhook.Load().(*WebhookClient)
+	return client
+}
+
+// SetWebhook replaces the webhook client, reviews in progress complete with the previous one.
+func SetWebhook(client *WebhookClient) {
+	webhook.Store(client)
+}
+
+type LoginContent struct {
+	AgentId      string
+	AgentVersion string
+	OS           string
+	Arch         string
+	RemoteAddr   string
+	Metadata     map[string]string
+}
+
+type NewTunnelContent struct {
+	AgentId  string
+	Tunnel   message.TunnelRequest
+	Metadata map[string]string
+}
+
+type NewConnectionContent struct {
+	AgentId    string
+	TunnelName string
+	TunnelType string
+	RemoteIp   string
+}
+
+type webhookRequest struct {
+	Operation string
+	Content   interface{}
+}
+
+// webhookResponse denies the operation unless Allow is set, a non empty Content replaces the
+// content of the request, e.g. to rewrite the port of a tunnel or to attach metadata.
+type webhookResponse struct {
+	Allow   bool
+	Reason  string
+	Content json.RawMessage
+}
+
+type cachedResponse struct {
+	response webhookResponse
+	expires  time.Time
+}
+
+// WebhookClient posts operations of agents to an external http endpoint deciding whether to
+// allow them. Answers are cached for cacheTtl, and when the endpoint fails the operation is
+// allowed unchanged with failOpen, denied otherwise.
+type WebhookClient struct {
+	url      string
+	failOpen bool
+	cacheTtl time.Duration
+	client   *http.Client
+
+	lock  sync.Mutex
+	cache map[string]cachedResponse
+}
+
+func NewWebhookClient(url string, timeout time.Duration, cacheTtl time.Duration, failOpen bool) *WebhookClient {
+	return &WebhookClient{
+		url:      url,
+		failOpen: failOpen,
+		cacheTtl: cacheTtl,
+		client:   &http.Client{Timeout: timeout},
+		cache:    map[string]cachedResponse{},
+	}
+}
+
+// Login reviews the bootstrap of an agent authenticated with token, returning the content as
+// modified by the webhook. The answer is cached for the agent and its token, whatever address
+// the agent connects from.
+func (w *WebhookClient) Login(content LoginContent, token string) (LoginContent, error) {
+	digest := sha256.Sum256([]byte(token))
+	cacheKey := struct {
+		LoginContent
+		Token string
+	}{content, hex.EncodeToString(digest[:])}
+	cacheKey.RemoteAddr = ""
+
+	err := w.review(LoginOperation, content, cacheKey, &content)
+	return content, err
+}
+
+// NewTunnel reviews the creation of a tunnel, returning the content as modified by the webhook.
+func (w *WebhookClient) NewTunnel(content NewTunnelContent) (NewTunnelContent, error) {
+	err := w.review(NewTunnelOperation, content, content, &content)
+	return content, err
+}
+
+func (w *WebhookClient) NewConnection(content NewConnectionContent) error {
+	return w.review(NewConnectionOperation, content, content, &content)
+}
+
+// review posts the content of the operation, the answer is cached under cacheKey, which leaves
+// out what differs between otherwise identical requests.
+func (w *WebhookClient) review(operation string, content interface{}, cacheKey interface{}, modifiedContent interface{}) error {
+	requestBytes, err := json.Marshal(webhookRequest{Operation: operation, Content: content})
+	if err != nil {
+		return err
+	}
+
+	keyBytes, err := json.Marshal(webhookRequest{Operation: operation, Content: cacheKey})
+	if err != nil {
+		return err
+	}
+
+	response, err := w.cachedCall(string(keyBytes), requestBytes)
+	if err != nil {
+		if w.failOpen {
+			log.WithField("operation", operation).WithError(err).Warn("error calling auth webhook, allowing by fail-open policy")
+			return nil
+		}
+		return errors.Wrap(err, "error calling auth webhook")
+	}
+
+	if !response.Allow {
+		if response.Reason != "" {
+			return errors.Wrap(ErrDenied, response.Reason)
+		}
+		return ErrDenied
+	}
+
+	if len(response.Content) != 0 && string(response.Content) != "null" {
+		if err = json.Unmarshal(response.Content, modifiedContent); err != nil {
+			return errors.Wrap(err, "error decoding content modified by auth webhook")
+		}
+	}
+
+	return nil
+}
+
+func (w *WebhookClient) cachedCall(key string, requestBytes []byte) (webhookResponse, error) {
+	if w.cacheTtl > 0 {
+		w.lock.Lock()
+		cached, ok := w.cache[key]
+		w.lock.Unlock()
+
+		if ok && time.Now().Before(cached.expires) {
+			return cached.response, nil
+		}
+	}
+
+	response, err := w.call(requestBytes)
+	if err != nil || w.cacheTtl <= 0 {
+		return response, err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.cache) >= maxCachedResponses {
+		now := time.Now()
+		for cachedKey, cached := range w.cache {
+			if now.After(cached.expires) {
+				delete(w.cache, cachedKey)
+			}
+		}
+	}
+
+	if len(w.cache) < maxCachedResponses {
+		w.cache[key] = cachedResponse{response: response, expires: time.Now().Add(w.cacheTtl)}
+	}
+
+	return response, nil
+}
+
+func (w *WebhookClient) call(requestBytes []byte) (webhookResponse, error) {
+	httpResponse, err := w.client.Post(w.url, "application/json", bytes.NewReader(requestBytes))
+	if err != nil {
+		return webhookResponse{}, err
+	}
+	defer httpResponse.Body.Close()
+
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return webhookResponse{}, err
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return webhookResponse{}, errors.New(fmt.Sprintf("unexpected status %s", httpResponse.Status))
+	}
+
+	response := webhookResponse{}
+	if err = json.Unmarshal(body, &response); err != nil {
+		return webhookResponse{}, err
+	}
+
+	return response, nil
+}
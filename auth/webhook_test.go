@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+
+		webhookRequest := struct {
+			Operation string
+			Content   NewTunnelContent
+		}{}
+		_ = json.NewDecoder(request.Body).Decode(&webhookRequest)
+
+		content := webhookRequest.Content
+		content.Tunnel.RemotePort = 20000
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{
+			"Allow":   content.AgentId == "ABC",
+			"Reason":  "unknown agent",
+			"Content": content,
+		})
+	}))
+	defer server.Close()
+
+	webhook := NewWebhookClient(server.URL, time.Second, time.Minute, false)
+
+	content, err := webhook.NewTunnel(NewTunnelContent{AgentId: "ABC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content.Tunnel.RemotePort != 20000 {
+		t.Fatalf("expected port rewritten to 20000, got %d", content.Tunnel.RemotePort)
+	}
+
+	if _, err = webhook.NewTunnel(NewTunnelContent{AgentId: "ABC"}); err != nil || calls != 1 {
+		t.Fatalf("expected cached response, got %v after %d calls", err, calls)
+	}
+
+	if _, err = webhook.NewTunnel(NewTunnelContent{AgentId: "XYZ"}); err == nil {
+		t.Fatal("expected agent XYZ to be denied")
+	}
+}
+
+func TestWebhookFailurePolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if err := NewWebhookClient(server.URL, time.Second, 0, true).NewConnection(NewConnectionContent{}); err != nil {
+		t.Fatalf("expected fail-open to allow, got %v", err)
+	}
+
+	if err := NewWebhookClient(server.URL, time.Second, 0, false).NewConnection(NewConnectionContent{}); err == nil {
+		t.Fatal("expected fail-closed to deny")
+	}
+}
+
+func TestWebhookNewConnection(t *testing.T) {
+	operations := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		webhookRequest := struct {
+			Operation string
+			Content   NewConnectionContent
+		}{}
+		_ = json.NewDecoder(request.Body).Decode(&webhookRequest)
+		operations <- webhookRequest.Operation
+
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{"Allow": webhookRequest.Content.RemoteIp != "10.0.0.1"})
+	}))
+	defer server.Close()
+
+	webhook := NewWebhookClient(server.URL, time.Second, 0, false)
+
+	if err := webhook.NewConnection(NewConnectionContent{AgentId: "ABC", TunnelName: "web", RemoteIp: "127.0.0.1"}); err != nil {
+		t.Fatalf("expected connection to be allowed, got %v", err)
+	}
+
+	if err := webhook.NewConnection(NewConnectionContent{AgentId: "ABC", TunnelName: "web", RemoteIp: "10.0.0.1"}); errors.Cause(err) != ErrDenied {
+		t.Fatalf("expected connection to be denied, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if operation := <-operations; operation != NewConnectionOperation {
+			t.Fatalf("expected public connection to be reviewed, got %s", operation)
+		}
+	}
+}
+
+func TestWebhookLoginCache(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		_ = json.NewEncoder(writer).Encode(map[string]interface{}{"Allow": true})
+	}))
+	defer server.Close()
+
+	webhook := NewWebhookClient(server.URL, time.Second, time.Minute, false)
+
+	logins := []struct {
+		remoteAddr string
+		token      string
+		calls      int
+	}{
+		{"10.0.0.1:40000", "secret", 1},
+		{"10.0.0.1:40001", "secret", 1},
+		{"10.0.0.2:40000", "secret", 1},
+		{"10.0.0.1:40002", "rotated", 2},
+	}
+
+	for _, login := range logins {
+		if _, err := webhook.Login(LoginContent{AgentId: "ABC", RemoteAddr: login.remoteAddr}, login.token); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != login.calls {
+			t.Fatalf("expected %d calls after login from %s, got %d", login.calls, login.remoteAddr, calls)
+		}
+	}
+}
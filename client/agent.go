@@ -2,10 +2,17 @@ package client
 
 import (
 	"context"
+	"fmt"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"sync/atomic"
 	"time"
 	"tunnel-transporter/config"
+	"tunnel-transporter/config/agent"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/metrics"
 	"tunnel-transporter/proxy"
+	"tunnel-transporter/status"
 	"tunnel-transporter/util"
 )
 
@@ -14,42 +21,155 @@ var (
 	cancel     context.CancelFunc
 	cancelChan chan error
 	closing    bool
+
+	// drained is closed once the agent stopping has drained its connections to local services.
+	drained = make(chan struct{})
 )
 
-func StartAgent() {
-	for {
+// StartAgent connects to the server until stopped, reconnecting with backoff after every
+// disconnection. It returns an error when the server rejected the agent or it gave up.
+func StartAgent() error {
+	if port := config.Get().Agent.Metrics.Port; port != 0 {
+		registerAgentMetrics()
+		go metrics.Serve(int(port))
+	}
+
+	if address := config.Get().Agent.Status.Address; address != "" {
+		go status.Serve(address, collectStatus)
+	}
+
+	go stopAgent()
+
+	failures := 0
+	for attempt := 0; !isStopping(); attempt++ {
+		if attempt > 0 {
+			atomic.AddUint64(&agentReconnects, 1)
+		}
+
 		ctx, cancel = context.WithCancel(context.Background())
-		cancelChan = make(chan error)
+		cancelChan = make(chan error, 1)
 		closing = false
+		setConnecting()
 
-		serverIp, serverPort := util.ResolveAddress(config.ClientConfig.Agent.ServerEndpoint)
-		conn, err := util.Dial(serverIp, serverPort)
+		serverIp, serverPort := util.ResolveAddress(config.Get().Agent.ServerEndpoint)
+		conn, err := util.DialWithTls(serverIp, serverPort, agent.TlsConfig)
 		if err != nil {
-			log.Errorf("error dialing tcp, reason: %v", err)
+			log.WithField(constants.AgentIdField, config.Get().Agent.Id).WithError(err).Error("error dialing server")
 			cancelChan <- err
 		} else {
-			proxy.NewBootstrapConnection(ctx, cancelChan, conn, false)
+			bootstrapConnection := proxy.NewBootstrapConnection(ctx, cancelChan, conn, false)
+			if bootstrapConnection != nil {
+				failures = 0
+				go logGoAway(ctx, bootstrapConnection)
+			}
+			setConnected(bootstrapConnection)
+		}
+
+		err = shutdown()
+		if isStopping() {
+			break
 		}
 
-		shutdown()
+		if errors.Cause(err) == proxy.ErrUnauthorized {
+			return errors.Wrap(err, "server rejected the agent")
+		}
+
+		failures++
+		if err = waitReconnect(failures); err != nil {
+			return err
+		}
 	}
+
+	log.WithField(constants.AgentIdField, config.Get().Agent.Id).Info("agent stopped")
+	return nil
 }
 
-func shutdown() {
+// waitReconnect waits before the attempt following the given number of consecutive failed
+// attempts, or returns an error once the agent reached the maximum attempts.
+func waitReconnect(failures int) error {
+	reconnect := config.Get().Agent.Reconnect
+	if reconnect.MaxAttempts > 0 && failures >= reconnect.MaxAttempts {
+		return errors.New(fmt.Sprintf("giving up after %d failed attempts to connect to server", failures))
+	}
+
+	delay := util.NewBackoff(reconnect.InitialDelay, reconnect.MaxDelay, reconnect.Multiplier, *reconnect.Jitter).Delay(failures)
+	setReconnecting(failures, delay)
+	log.WithFields(log.Fields{constants.AgentIdField: config.Get().Agent.Id, "attempt": failures + 1, "delay": delay.String()}).Warn("reconnecting to server")
+
 	select {
-	case err := <-cancelChan:
-		if closing {
-			return
+	case <-stopping:
+	case <-time.After(delay):
+	}
+
+	return nil
+}
+
+// stopAgent waits for SIGTERM or SIGINT, then tells the server the agent is going away and
+// waits up to the drain timeout for the connections to local services to end.
+func stopAgent() {
+	waitStopSignal()
+	defer close(drained)
+
+	bootstrapConnection := currentBootstrapConnection()
+	if bootstrapConnection == nil {
+		return
+	}
+	bootstrapConnection.GoAway("agent shutting down")
+
+	activeConnections := func() int {
+		active := 0
+		for _, connections := range bootstrapConnection.ActiveConnections() {
+			active += connections
 		}
+		return active
+	}
 
-		closing = true
-		log.Errorf("shutting down agent due to error: %v", err)
+	drainTimeout := config.Get().Agent.DrainTimeout
+	log.WithFields(log.Fields{constants.AgentIdField: config.Get().Agent.Id, "connections": activeConnections(), "timeout": drainTimeout.String()}).Info("draining connections to local services")
+	if !waitDrained(drainTimeout, activeConnections) {
+		log.WithFields(log.Fields{constants.AgentIdField: config.Get().Agent.Id, "connections": activeConnections()}).Warn("drain timeout elapsed, closing remaining connections")
+	}
+}
 
-		close(cancelChan)
-		cancel()
+// logGoAway reports the server announcing it is going away, the agent keeps serving the
+// connections already joined and reconnects once the server closed the control connection.
+func logGoAway(ctx context.Context, bootstrapConnection *proxy.BootstrapConnection) {
+	select {
+	case <-ctx.Done():
+	case <-bootstrapConnection.GoingAway():
+		log.WithFields(log.Fields{constants.AgentIdField: config.Get().Agent.Id, "reason": bootstrapConnection.GoAwayReason()}).Warn("server is going away, reconnecting once it closes the connection")
+	}
+}
 
-		log.Errorf("completed shutting down agent")
+func shutdown() error {
+	var err error
+	select {
+	case err = <-cancelChan:
+	case <-drained:
+		err = errors.New("agent shutting down")
+	}
+
+	if closing {
+		return err
 	}
 
-	time.Sleep(5 * time.Second)
+	if bootstrapConnection := currentBootstrapConnection(); bootstrapConnection != nil {
+		if reason := bootstrapConnection.GoAwayReason(); reason != "" {
+			err = errors.Wrap(err, fmt.Sprintf("server going away, %s", reason))
+		}
+	}
+
+	closing = true
+	if isStopping() {
+		log.WithField(constants.AgentIdField, config.Get().Agent.Id).WithError(err).Info("shutting down agent")
+	} else {
+		log.WithField(constants.AgentIdField, config.Get().Agent.Id).WithError(err).Error("shutting down agent due to error")
+	}
+
+	close(cancelChan)
+	cancel()
+	setDisconnected(err)
+
+	log.WithField(constants.AgentIdField, config.Get().Agent.Id).Error("completed shutting down agent")
+	return err
 }
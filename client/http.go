@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/proxy"
+	"tunnel-transporter/util"
+)
+
+const httpHeaderTimeout = 30 * time.Second
+
+func startHttpServer() {
+	port := int(config.Get().Server.Http.Port)
+	listener, err := util.Listen(port)
+	if err != nil {
+		log.WithField("port", port).WithError(err).Panic("error while listening http")
+		return
+	}
+	defer listener.Close()
+	go closeOnStop(listener)
+
+	log.WithField("port", port).Info("routing http requests by host")
+
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			if isStopping() {
+				return
+			}
+			log.WithError(err).Error("error while accepting http connection")
+			continue
+		}
+
+		go handleHttpConnection(conn)
+	}
+}
+
+// handleHttpConnection reads the first request to find the tunnel bound to its Host header,
+// then hands the raw connection, including the bytes already read, over to the tunnel.
+func handleHttpConnection(conn net.Conn) {
+	consumed := &bytes.Buffer{}
+	reader := bufio.NewReader(io.TeeReader(conn, consumed))
+
+	_ = conn.SetReadDeadline(time.Now().Add(httpHeaderTimeout))
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		log.WithField(constants.RemoteAddrField, conn.RemoteAddr().String()).WithError(err).Debug("error reading http request")
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	tunnel := proxyRegistry.GetByHost(constants.HTTP, request.Host)
+	if tunnel == nil {
+		log.WithFields(log.Fields{constants.RemoteAddrField: conn.RemoteAddr().String(), constants.HostField: request.Host}).Debug("no tunnel bound to host")
+		writeErrorPage(conn, http.StatusNotFound, fmt.Sprintf("No tunnel is bound to host %s.", request.Host))
+		conn.Close()
+		return
+	}
+
+	tunnel.ForwardWith(util.NewPrefixConnection(conn, consumed.Bytes()), func(backendConnection net.Conn, err error) net.Conn {
+		switch cause := errors.Cause(err); {
+		case cause == proxy.ErrAccessDenied:
+			writeErrorPage(conn, http.StatusForbidden, fmt.Sprintf("Access to host %s is denied.", request.Host))
+			return nil
+		case cause == proxy.ErrConnectionRefused:
+			writeErrorPage(conn, http.StatusServiceUnavailable, fmt.Sprintf("Host %s does not accept more connections for now.", request.Host))
+			return nil
+		case err != nil:
+			writeErrorPage(conn, http.StatusBadGateway, fmt.Sprintf("The agent serving host %s is not reachable.", request.Host))
+			return nil
+		}
+
+		return &badGatewayConnection{Conn: backendConnection, public: conn, host: request.Host}
+	})
+}
+
+// badGatewayConnection answers with a 502 page when the backend connection fails before
+// sending any byte, e.g. when the agent could not reach its local service.
+type badGatewayConnection struct {
+	net.Conn
+	public   net.Conn
+	host     string
+	received bool
+}
+
+func (b *badGatewayConnection) Read(buffer []byte) (int, error) {
+	n, err := b.Conn.Read(buffer)
+	if n > 0 {
+		b.received = true
+	}
+
+	if err != nil && !b.received {
+		b.received = true
+		writeErrorPage(b.public, http.StatusBadGateway, fmt.Sprintf("The agent serving host %s is not reachable.", b.host))
+	}
+
+	return n, err
+}
+
+func writeErrorPage(conn net.Conn, statusCode int, detail string) {
+	status := fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
+	body := fmt.Sprintf("<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<p>%s</p>\n<hr>\n<p>tunnel-transporter</p>\n</body>\n</html>\n",
+		status, status, html.EscapeString(detail))
+
+	response := &http.Response{
+		StatusCode:    statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/html; charset=utf-8"}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		Close:         true,
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(httpHeaderTimeout))
+	_ = response.Write(conn)
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+	"tunnel-transporter/access"
+	"tunnel-transporter/auth"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/message"
+	"tunnel-transporter/proxy"
+	"tunnel-transporter/registry"
+)
+
+// startHttpTunnel registers an agent with an http tunnel bound to web.example.com. The agent
+// never answers, so opening a connection to its local service times out.
+func startHttpTunnel(t *testing.T, limits message.TunnelLimits) *proxy.Tunnel {
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	content := "server:\n  port: 18080\n  connection-timeout: 200ms\n  http:\n    port: 18081\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	serverSide, agentSide := net.Pipe()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, agentSide)
+	}()
+	t.Cleanup(func() {
+		agentSide.Close()
+	})
+
+	requestMessage := message.BootstrapRequestMessage{
+		AgentId: "ABC",
+		Tunnels: []message.TunnelRequest{{Name: "web", Type: constants.HTTP, CustomDomains: []string{"web.example.com"}, Limits: limits}},
+	}
+
+	proxyRegistry = registry.NewRegistryManager()
+	tunnelProxy, err := proxy.NewProxy(requestMessage, auth.Identity{AgentId: "ABC"}, serverSide, proxyRegistry, proxyRegistry.UnregisterChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyRegistry.Put(tunnelProxy)
+
+	return tunnelProxy.Tunnels["web"]
+}
+
+// sendHttpRequest sends a request for the host with an http client to handleHttpConnection and
+// returns the status code of the response.
+func sendHttpRequest(t *testing.T, host string) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			handleHttpConnection(conn)
+		}
+	}()
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Host = host
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	return response.StatusCode
+}
+
+func TestHttpTunnelErrorPages(t *testing.T) {
+	tunnel := startHttpTunnel(t, message.TunnelLimits{Rate: 0.001, Burst: 1})
+
+	if status := sendHttpRequest(t, "other.example.com"); status != http.StatusNotFound {
+		t.Fatalf("expected unknown host not to be found, got %d", status)
+	}
+
+	if status := sendHttpRequest(t, "web.example.com"); status != http.StatusBadGateway {
+		t.Fatalf("expected unreachable agent to answer bad gateway, got %d", status)
+	}
+
+	if status := sendHttpRequest(t, "web.example.com"); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected rate limited connection to answer service unavailable, got %d", status)
+	}
+
+	path := filepath.Join(t.TempDir(), "access.yaml")
+	if err := ioutil.WriteFile(path, []byte("deny: [127.0.0.1]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	control, err := access.NewAccessControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access.Control = control
+	defer func() {
+		access.Control = nil
+	}()
+
+	if status := sendHttpRequest(t, "web.example.com"); status != http.StatusForbidden {
+		t.Fatalf("expected denied source to answer forbidden, got %d", status)
+	}
+
+	if denied, refused := tunnel.DeniedConnections(), tunnel.RefusedConnections(); denied != 1 || refused != 1 {
+		t.Fatalf("expected 1 denied and 1 refused connection, got %d and %d", denied, refused)
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"time"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/util"
+)
+
+const clientHelloTimeout = 10 * time.Second
+
+func startHttpsServer() {
+	port := int(config.Get().Server.Https.Port)
+	listener, err := util.Listen(port)
+	if err != nil {
+		log.WithField("port", port).WithError(err).Panic("error while listening https")
+		return
+	}
+	defer listener.Close()
+	go closeOnStop(listener)
+
+	log.WithField("port", port).Info("routing tls connections by server name")
+
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			if isStopping() {
+				return
+			}
+			log.WithError(err).Error("error while accepting https connection")
+			continue
+		}
+
+		go handleHttpsConnection(conn)
+	}
+}
+
+// handleHttpsConnection peeks the SNI server name from the ClientHello and passes the
+// still encrypted connection through to the tunnel bound to it, tls is terminated by
+// the local service behind the agent.
+func handleHttpsConnection(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, consumed, err := util.ReadServerName(conn)
+	if err != nil {
+		log.WithField(constants.RemoteAddrField, conn.RemoteAddr().String()).WithError(err).Debug("error reading server name")
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	tunnel := proxyRegistry.GetByHost(constants.HTTPS, serverName)
+	if tunnel == nil {
+		log.WithFields(log.Fields{constants.RemoteAddrField: conn.RemoteAddr().String(), constants.HostField: serverName}).Debug("no tunnel bound to server name")
+		conn.Close()
+		return
+	}
+
+	tunnel.Forward(util.NewPrefixConnection(conn, consumed))
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"sync/atomic"
+	"tunnel-transporter/metrics"
+)
+
+var agentReconnects uint64
+
+func registerServerMetrics() {
+	metrics.NewGaugeFunc("agents", "Agents connected to the server.", func(emit func(value float64, labelValues ...string)) {
+		emit(float64(len(proxyRegistry.Proxies())))
+	})
+
+	metrics.NewGaugeFunc("tunnels", "Tunnels opened by connected agents.", func(emit func(value float64, labelValues ...string)) {
+		counts := map[string]int{}
+		for _, tunnelProxy := range proxyRegistry.Proxies() {
+			for _, tunnel := range tunnelProxy.Tunnels {
+				counts[string(tunnel.Type)]++
+			}
+		}
+
+		for tunnelType, count := range counts {
+			emit(float64(count), tunnelType)
+		}
+	}, "type")
+
+	metrics.NewGaugeFunc("public_connections_active", "Public connections currently joined with a local service.", func(emit func(value float64, labelValues ...string)) {
+		for _, tunnelProxy := range proxyRegistry.Proxies() {
+			for _, tunnel := range tunnelProxy.Tunnels {
+				emit(float64(tunnel.ActiveConnections()), tunnel.AgentId, tunnel.Name)
+			}
+		}
+	}, "agent", "tunnel")
+
+	metrics.NewGaugeFunc("heartbeat_rtt_seconds", "Heartbeat round trip time to each agent.", func(emit func(value float64, labelValues ...string)) {
+		for _, tunnelProxy := range proxyRegistry.Proxies() {
+			if tunnelProxy.BootstrapConnection != nil {
+				emit(tunnelProxy.BootstrapConnection.RoundTripTime().Seconds(), tunnelProxy.AgentId)
+			}
+		}
+	}, "agent")
+}
+
+func registerAgentMetrics() {
+	metrics.NewCounterFunc("agent_reconnects_total", "Times the agent reconnected to the server.", func(emit func(value float64, labelValues ...string)) {
+		emit(float64(atomic.LoadUint64(&agentReconnects)))
+	})
+
+	metrics.NewGaugeFunc("agent_reconnect_failed_attempts", "Consecutive failed attempts to connect to the server, zero once connected.", func(emit func(value float64, labelValues ...string)) {
+		failures, _ := reconnectState()
+		emit(float64(failures))
+	})
+
+	metrics.NewGaugeFunc("agent_reconnect_delay_seconds", "Delay before the current attempt to reconnect to the server, zero once connected.", func(emit func(value float64, labelValues ...string)) {
+		_, delay := reconnectState()
+		emit(delay.Seconds())
+	})
+
+	metrics.NewGaugeFunc("agent_connected", "Whether the agent is connected to the server.", func(emit func(value float64, labelValues ...string)) {
+		connected := 0.0
+		if currentBootstrapConnection() != nil {
+			connected = 1
+		}
+		emit(connected)
+	})
+
+	metrics.NewGaugeFunc("heartbeat_rtt_seconds", "Heartbeat round trip time to the server.", func(emit func(value float64, labelValues ...string)) {
+		if connection := currentBootstrapConnection(); connection != nil {
+			emit(connection.RoundTripTime().Seconds())
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+	"tunnel-transporter/auth"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/util"
+)
+
+const configWatchInterval = 5 * time.Second
+
+var reloadLock sync.Mutex
+
+// WatchConfig reloads the configuration file on SIGHUP and whenever it is modified, running
+// tunnels are kept and changes needing a restart are reported and ignored.
+func WatchConfig(configPath string, mode constants.Mode) {
+	go util.WatchFile(configPath, configWatchInterval, func() error {
+		return reloadConfig(configPath, mode)
+	})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := reloadConfig(configPath, mode); err != nil {
+			log.WithField("path", configPath).WithError(err).Error("error reloading configuration, keeping the running configuration")
+			continue
+		}
+		log.WithField("path", configPath).Info("reloaded configuration")
+	}
+}
+
+func reloadConfig(configPath string, mode constants.Mode) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	previous, restart, err := config.Reload(configPath, mode)
+	if err != nil {
+		return err
+	}
+
+	if mode == constants.ServerMode {
+		applyServerConfig(previous)
+	}
+
+	for _, setting := range restart {
+		log.WithField(constants.SettingField, setting).Warn("configuration change needs a restart to take effect")
+	}
+
+	return nil
+}
+
+// applyServerConfig replaces the server components built from settings changed since the
+// previous configuration, the others read the configuration whenever they are used.
+func applyServerConfig(previous *config.Config) {
+	serverConfig := config.Get().Server
+
+	signedToken := serverConfig.Authentication.SignedToken
+	if serverConfig.Authentication.Type == constants.SignedToken && !reflect.DeepEqual(signedToken, previous.Server.Authentication.SignedToken) {
+		tokenKey, err := createTokenKey()
+		if err != nil {
+			log.WithError(err).Error("error loading signed token key, keeping the previous key")
+		} else {
+			auth.SetTokenKey(tokenKey)
+		}
+	}
+
+	if webhook := serverConfig.Authentication.Webhook; !reflect.DeepEqual(webhook, previous.Server.Authentication.Webhook) {
+		if webhook.Url == "" {
+			auth.SetWebhook(nil)
+		} else {
+			auth.SetWebhook(auth.NewWebhookClient(webhook.Url, webhook.Timeout, webhook.CacheTtl, webhook.FailOpen))
+		}
+	}
+}
@@ -1,15 +1,25 @@
 package client
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"time"
+	"tunnel-transporter/access"
+	"tunnel-transporter/accesslog"
+	"tunnel-transporter/admin"
+	"tunnel-transporter/auth"
 	"tunnel-transporter/config"
+	"tunnel-transporter/config/server"
 	"tunnel-transporter/constants"
+	"tunnel-transporter/dashboard"
 	"tunnel-transporter/message"
+	"tunnel-transporter/metrics"
 	"tunnel-transporter/proxy"
 	"tunnel-transporter/registry"
+	"tunnel-transporter/traffic"
 	"tunnel-transporter/util"
 )
 
@@ -18,67 +28,323 @@ var (
 )
 
 func StartServer() {
-	listener, err := util.Listen(int(config.ClientConfig.Server.Port))
+	listener, err := util.Listen(int(config.Get().Server.Port))
+	if err != nil {
+		log.WithField("port", config.Get().Server.Port).WithError(err).Panic("error while listening")
+		return
+	}
 	defer listener.Close()
 
+	credentials := config.Get().Server.Authentication.Credentials
+	if credentials.Path != "" {
+		store, err := auth.NewCredentialsStore(credentials.Path)
+		if err != nil {
+			log.WithField("path", credentials.Path).WithError(err).Panic("error loading credentials file")
+			return
+		}
+
+		auth.Credentials = store
+		go store.Watch(credentials.ReloadInterval)
+	}
+
+	if config.Get().Server.Authentication.Type == constants.SignedToken {
+		tokenKey, err := createTokenKey()
+		if err != nil {
+			log.WithError(err).Panic("error loading signed token key")
+			return
+		}
+		auth.SetTokenKey(tokenKey)
+	}
+
+	trafficManager, err := traffic.NewTrafficManager(config.Get().Server.Traffic)
 	if err != nil {
-		_, port := util.ResolveAddress(listener.Addr().String())
-		log.Panicf("error while listening on %d, reason: %v", port, err)
+		log.WithError(err).Panic("error creating traffic manager")
 		return
 	}
+	traffic.Manager = trafficManager
+	go trafficManager.Persist(config.Get().Server.Traffic.SaveInterval)
+
+	accessControl := config.Get().Server.AccessControl
+	if accessControl.Path != "" {
+		control, err := access.NewAccessControl(accessControl.Path)
+		if err != nil {
+			log.WithField("path", accessControl.Path).WithError(err).Panic("error loading access control file")
+			return
+		}
+
+		access.Control = control
+		go control.Watch(accessControl.ReloadInterval)
+	}
 
+	if accessLog := config.Get().Server.AccessLog; accessLog.Path != "" {
+		file, err := accesslog.NewAccessLog(accessLog.Path, accessLog.Format, accessLog.Template)
+		if err != nil {
+			log.WithField("path", accessLog.Path).WithError(err).Panic("error opening access log")
+			return
+		}
+		accesslog.Log = file
+	}
+
+	if webhook := config.Get().Server.Authentication.Webhook; webhook.Url != "" {
+		auth.SetWebhook(auth.NewWebhookClient(webhook.Url, webhook.Timeout, webhook.CacheTtl, webhook.FailOpen))
+	}
+
+	if port := config.Get().Server.Metrics.Port; port != 0 {
+		registerServerMetrics()
+		go metrics.Serve(int(port))
+	}
+
+	if adminApi := config.Get().Server.Admin; adminApi.Port != 0 {
+		go admin.NewServer(proxyRegistry, adminApi.Token).Serve(int(adminApi.Port))
+	}
+
+	if ui := config.Get().Server.Dashboard; ui.Port != 0 {
+		go dashboard.NewDashboard(proxyRegistry, ui.Username, ui.Password).Serve(int(ui.Port))
+	}
+
+	if config.Get().Server.Http.Port != 0 {
+		go startHttpServer()
+	}
+
+	if config.Get().Server.Https.Port != 0 {
+		go startHttpsServer()
+	}
+
+	var agentListener net.Listener = listener
+	if server.TlsConfig != nil {
+		agentListener = tls.NewListener(listener, server.TlsConfig)
+	}
+
+	go acceptAgentConnections(agentListener)
+
+	waitStopSignal()
+	_ = listener.Close()
+	shutdownServer()
+}
+
+func acceptAgentConnections(listener net.Listener) {
 	for {
-		conn, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Errorf("error while accepting connection, reason: %v", err)
+			if isStopping() {
+				return
+			}
+			log.WithError(err).Error("error while accepting connection")
+			continue
 		}
 
 		go handleAgentConnection(conn)
 	}
 }
 
-func handleAgentConnection(conn *net.TCPConn) {
+// shutdownServer tells every agent the server is going away and waits up to the drain timeout
+// for the public connections already joined to end, before closing the remaining ones.
+func shutdownServer() {
+	drainTimeout := config.Get().Server.DrainTimeout
+	proxies := proxyRegistry.Proxies()
+	for _, tunnelProxy := range proxies {
+		tunnelProxy.Drain("server shutting down")
+	}
+
+	activeConnections := func() int {
+		active := 0
+		for _, tunnelProxy := range proxies {
+			active += tunnelProxy.ActiveConnections()
+		}
+		return active
+	}
+
+	log.WithFields(log.Fields{"connections": activeConnections(), "timeout": drainTimeout.String()}).Info("draining public connections")
+	if !waitDrained(drainTimeout, activeConnections) {
+		log.WithField("connections", activeConnections()).Warn("drain timeout elapsed, closing remaining public connections")
+		for _, tunnelProxy := range proxies {
+			tunnelProxy.CloseConnections()
+		}
+		waitDrained(time.Second, activeConnections)
+	}
+
+	for _, tunnelProxy := range proxies {
+		tunnelProxy.Close(errors.New("server shutting down"))
+	}
+
+	if traffic.Manager != nil {
+		if err := traffic.Manager.Save(); err != nil {
+			log.WithError(err).Error("error saving traffic state")
+		}
+	}
+
+	if accesslog.Log != nil {
+		_ = accesslog.Log.Close()
+	}
+
+	log.Info("completed shutting down server")
+}
+
+func handleAgentConnection(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(proxy.HandshakeTimeout))
+	nonce := auth.NewNonce()
+	if err := util.Write(conn, message.AuthChallengeMessage{Nonce: nonce}); err != nil {
+		log.WithField(constants.RemoteAddrField, conn.RemoteAddr().String()).WithError(err).Error("error writing auth challenge")
+		conn.Close()
+		return
+	}
+
 	firstMessage, err := util.Read(conn)
 	if err != nil || firstMessage == nil {
-		log.Errorf("error reading message from connection, reason: %v", err)
+		log.WithField(constants.RemoteAddrField, conn.RemoteAddr().String()).WithError(err).Error("error reading message from connection")
+		conn.Close()
 		return
 	}
+	_ = conn.SetDeadline(time.Time{})
 
 	switch firstMessage.GetType() {
 	case message.BootstrapRequest:
-		if err := handleBootstrapConnection(*firstMessage.(*message.BootstrapRequestMessage), conn); err != nil {
-			log.Errorf("error handling bootstrap connection, reason: %v", err)
+		if err := handleBootstrapConnection(*firstMessage.(*message.BootstrapRequestMessage), nonce, conn); err != nil {
+			log.WithFields(log.Fields{constants.AgentIdField: firstMessage.(*message.BootstrapRequestMessage).AgentId, constants.RemoteAddrField: conn.RemoteAddr().String()}).WithError(err).Error("error handling bootstrap connection")
 		}
 	case message.RequireConnectionResponse:
-		handleNewConnection(*firstMessage.(*message.RequireNewConnectionResponseMessage), conn)
+		handleNewConnection(*firstMessage.(*message.RequireNewConnectionResponseMessage), nonce, conn)
 	default:
-		log.Warn("received unknown message")
+		log.WithField(constants.RemoteAddrField, conn.RemoteAddr().String()).Warn("received unknown message")
 	}
 }
 
-func handleBootstrapConnection(requestMessage message.BootstrapRequestMessage, conn *net.TCPConn) error {
-	if config.ClientConfig.Server.Authentication.Type == constants.StaticToken {
-		if requestMessage.StaticToken != config.ClientConfig.Server.Authentication.StaticToken.Token {
-			_ = util.Write(conn, message.BootstrapResponseMessage{Error: "invalid token"})
+func handleBootstrapConnection(requestMessage message.BootstrapRequestMessage, nonce string, conn net.Conn) error {
+	if config.Get().Server.Authentication.Type == constants.Certificate {
+		if err := verifyCertificateIdentity(conn, requestMessage.AgentId); err != nil {
+			_ = util.Write(conn, message.BootstrapResponseMessage{Error: err.Error(), Unauthorized: true})
+			conn.Close()
+			return errors.Wrap(err, fmt.Sprintf("agent %s bootstrap with invalid certificate", requestMessage.AgentId))
+		}
+	}
+
+	identity := auth.Identity{AgentId: requestMessage.AgentId, Nonce: nonce}
+
+	switch config.Get().Server.Authentication.Type {
+	case constants.StaticToken:
+		identity.Token = auth.AgentToken(requestMessage.AgentId)
+
+		replayWindow := config.Get().Server.Authentication.StaticToken.ReplayWindow
+		if err := auth.Verify(identity.Token, nonce, requestMessage.AgentId, requestMessage.Timestamp, requestMessage.Proof, replayWindow); err != nil {
+			_ = util.Write(conn, message.BootstrapResponseMessage{Error: "invalid token", Unauthorized: true})
 			conn.Close()
-			return errors.New(fmt.Sprintf("agent %s bootstrap with invalid token", requestMessage.AgentId))
+			return errors.Wrap(err, fmt.Sprintf("agent %s bootstrap with invalid token", requestMessage.AgentId))
+		}
+	case constants.SignedToken:
+		// the agent proves to hold its token by a proof keyed by the signature
+		token, claims, err := auth.TokenKey().Complete(requestMessage.Token)
+		if err == nil && claims.AgentId != requestMessage.AgentId {
+			err = errors.New(fmt.Sprintf("token is issued for agent %s", claims.AgentId))
+		}
+
+		if err == nil {
+			_, signature := auth.SplitToken(token)
+			replayWindow := config.Get().Server.Authentication.SignedToken.ReplayWindow
+			err = auth.Verify(signature, nonce, requestMessage.AgentId, requestMessage.Timestamp, requestMessage.Proof, replayWindow)
+		}
+
+		if err != nil {
+			_ = util.Write(conn, message.BootstrapResponseMessage{Error: err.Error(), Unauthorized: true})
+			conn.Close()
+			return errors.Wrap(err, fmt.Sprintf("agent %s bootstrap with invalid signed token", requestMessage.AgentId))
+		}
+
+		identity.Token = token
+		identity.Claims = claims
+	}
+
+	// checked once the agent proved its token, an unknown agent fails above like any invalid token
+	if auth.Credentials != nil {
+		if _, err := auth.Credentials.Check(requestMessage.AgentId); err != nil {
+			_ = util.Write(conn, message.BootstrapResponseMessage{Error: err.Error(), Unauthorized: true})
+			conn.Close()
+			return errors.Wrap(err, fmt.Sprintf("agent %s bootstrap rejected by credentials store", requestMessage.AgentId))
 		}
 	}
 
-	tunnel, err := proxy.NewProxy(requestMessage.AgentId, requestMessage.AgentVersion, conn, proxyRegistry.UnregisterChan)
+	if webhook := auth.Webhook(); webhook != nil {
+		content, err := webhook.Login(auth.LoginContent{
+			AgentId:      requestMessage.AgentId,
+			AgentVersion: requestMessage.AgentVersion,
+			OS:           requestMessage.OS,
+			Arch:         requestMessage.Arch,
+			RemoteAddr:   conn.RemoteAddr().String(),
+		}, identity.Token)
+		if err != nil {
+			// only an explicit denial is final, the agent retries when the webhook could not be reached
+			_ = util.Write(conn, message.BootstrapResponseMessage{Error: err.Error(), Unauthorized: errors.Cause(err) == auth.ErrDenied})
+			conn.Close()
+			return errors.Wrap(err, fmt.Sprintf("agent %s bootstrap rejected by auth webhook", requestMessage.AgentId))
+		}
+		identity.Metadata = content.Metadata
+	}
+
+	if previousProxy := proxyRegistry.GetByAgentId(requestMessage.AgentId); previousProxy != nil {
+		log.WithField(constants.AgentIdField, requestMessage.AgentId).Warn("agent reconnected, closing previous tunnels")
+		previousProxy.Close(errors.New("replaced by a new bootstrap connection"))
+	}
+
+	tunnelProxy, err := proxy.NewProxy(requestMessage, identity, conn, proxyRegistry, proxyRegistry.UnregisterChan)
 	if err != nil {
-		log.Errorf("error creating new tunnel, reason: %v", err)
+		log.WithField(constants.AgentIdField, requestMessage.AgentId).WithError(err).Error("error creating new tunnel")
+		_ = util.Write(conn, message.BootstrapResponseMessage{Error: err.Error()})
+		conn.Close()
 		return err
 	}
 
-	proxyRegistry.Put(tunnel.PublicListenPort, tunnel)
+	proxyRegistry.Put(tunnelProxy)
 	return nil
 }
 
-func handleNewConnection(responseMessage message.RequireNewConnectionResponseMessage, conn *net.TCPConn) {
+func handleNewConnection(responseMessage message.RequireNewConnectionResponseMessage, nonce string, conn net.Conn) {
+	if config.Get().Server.Authentication.Type == constants.Certificate {
+		if err := verifyCertificateIdentity(conn, responseMessage.AgentId); err != nil {
+			log.WithFields(log.Fields{constants.AgentIdField: responseMessage.AgentId, constants.ConnIdField: responseMessage.ConnectionId}).WithError(err).Warn("rejecting data connection")
+			conn.Close()
+			return
+		}
+	}
+
 	if tunnelProxy := proxyRegistry.GetByAgentId(responseMessage.AgentId); tunnelProxy == nil {
-		log.Warnf("fail to find tunnel proxy for agent %s", responseMessage.AgentId)
+		log.WithFields(log.Fields{constants.AgentIdField: responseMessage.AgentId, constants.ConnIdField: responseMessage.ConnectionId}).Warn("fail to find tunnel proxy")
+		conn.Close()
 	} else {
-		tunnelProxy.HandleNewDataConnection(responseMessage, conn)
+		tunnelProxy.HandleNewDataConnection(responseMessage, nonce, conn)
+	}
+}
+
+func createTokenKey() (*auth.SigningKey, error) {
+	signedToken := config.Get().Server.Authentication.SignedToken
+	if signedToken.Algorithm == auth.Ed25519Algorithm {
+		return auth.LoadEd25519PublicKey(signedToken.PublicKeyPath)
 	}
+
+	return auth.NewHmacKey(signedToken.Secret), nil
+}
+
+// verifyCertificateIdentity checks that the agent id matches the common name or one of
+// the DNS names of the client certificate presented on conn.
+func verifyCertificateIdentity(conn net.Conn, agentId string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return errors.New("connection is not using tls")
+	}
+
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return errors.New("missing client certificate")
+	}
+
+	certificate := certificates[0]
+	if certificate.Subject.CommonName == agentId {
+		return nil
+	}
+
+	for _, name := range certificate.DNSNames {
+		if name == agentId {
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("agent id %s does not match client certificate", agentId))
 }
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+	"tunnel-transporter/auth"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/message"
+	"tunnel-transporter/util"
+)
+
+func newSelfSignedCertificate(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{certificate}, PrivateKey: key}
+}
+
+// acceptTls returns the server side of a tls connection from an agent presenting the
+// certificates, after the handshake.
+func acceptTls(t *testing.T, agentCertificates []tls.Certificate) net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: agentCertificates})
+		if err == nil {
+			_, _ = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{newSelfSignedCertificate(t, "localhost")},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err = tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tlsConn.Close()
+	})
+
+	return tlsConn
+}
+
+func TestVerifyCertificateIdentity(t *testing.T) {
+	agentCertificate := newSelfSignedCertificate(t, "ABC", "abc.agents.example.com", "DEF")
+	plainServer, plainAgent := net.Pipe()
+	defer plainServer.Close()
+	defer plainAgent.Close()
+
+	cases := []struct {
+		description string
+		conn        net.Conn
+		agentId     string
+		valid       bool
+	}{
+		{"common name", acceptTls(t, []tls.Certificate{agentCertificate}), "ABC", true},
+		{"dns name", acceptTls(t, []tls.Certificate{agentCertificate}), "DEF", true},
+		{"other agent", acceptTls(t, []tls.Certificate{agentCertificate}), "GHI", false},
+		{"no certificate", acceptTls(t, nil), "ABC", false},
+		{"no tls", plainServer, "ABC", false},
+	}
+
+	for _, c := range cases {
+		if err := verifyCertificateIdentity(c.conn, c.agentId); (err == nil) != c.valid {
+			t.Fatalf("expected %s identity to be valid %t, got %v", c.description, c.valid, err)
+		}
+	}
+}
+
+func TestBootstrapUnknownAgent(t *testing.T) {
+	directory := t.TempDir()
+	credentialsPath := filepath.Join(directory, "credentials.yaml")
+	if err := ioutil.WriteFile(credentialsPath, []byte("agents:\n  ABC:\n    token: secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(directory, "tunnel-config.yaml")
+	content := "server:\n  port: 18080\n  authentication:\n    type: static-token\n    credentials:\n      path: " + credentialsPath + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := auth.NewCredentialsStore(credentialsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Credentials = store
+	defer func() {
+		auth.Credentials = nil
+	}()
+
+	// an unknown agent is told the same as a known one failing to prove its token
+	for _, agentId := range []string{"ABC", "XYZ"} {
+		serverSide, agentSide := net.Pipe()
+		nonce := auth.NewNonce()
+		timestamp := time.Now().Unix()
+		requestMessage := message.BootstrapRequestMessage{AgentId: agentId, Timestamp: timestamp, Proof: auth.Sign("guessed", nonce, agentId, timestamp)}
+		go func() {
+			_ = handleBootstrapConnection(requestMessage, nonce, serverSide)
+		}()
+
+		responseMessage, err := util.Read(agentSide)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agentSide.Close()
+
+		response := responseMessage.(*message.BootstrapResponseMessage)
+		if response.Error != "invalid token" || !response.Unauthorized {
+			t.Fatalf("expected agent %s to be unauthorized with invalid token, got %+v", agentId, response)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const drainPollInterval = 100 * time.Millisecond
+
+// stopping is closed once SIGTERM or SIGINT is received, listeners stop accepting and the
+// agent stops reconnecting.
+var stopping = make(chan struct{})
+
+// waitStopSignal blocks until SIGTERM or SIGINT is received, a second signal terminates the
+// process right away.
+func waitStopSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	received := <-signals
+	signal.Stop(signals)
+	log.WithField("signal", received.String()).Info("received signal, shutting down")
+
+	close(stopping)
+}
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeOnStop closes the listener once the process is stopping.
+func closeOnStop(listener io.Closer) {
+	<-stopping
+	_ = listener.Close()
+}
+
+// waitDrained waits until no connection is active or the timeout elapsed, true when drained.
+func waitDrained(timeout time.Duration, active func() int) bool {
+	deadline := time.Now().Add(timeout)
+	for active() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	return true
+}
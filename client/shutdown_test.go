@@ -0,0 +1,183 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+	"tunnel-transporter/auth"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/message"
+	"tunnel-transporter/mux"
+	"tunnel-transporter/proxy"
+	"tunnel-transporter/registry"
+	"tunnel-transporter/util"
+)
+
+// startEchoTunnel registers a multiplexed agent with a tcp tunnel whose local service echoes,
+// the returned channel receives the messages the server sends over the control stream.
+func startEchoTunnel(t *testing.T, drainTimeout string) (*proxy.Tunnel, <-chan message.TypedMessage) {
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	if err := ioutil.WriteFile(path, []byte("server:\n  port: 18080\n  drain-timeout: "+drainTimeout+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	serverSide, agentSide := net.Pipe()
+	controlMessages := make(chan message.TypedMessage, 16)
+	go func() {
+		if _, err := util.Read(agentSide); err != nil {
+			return
+		}
+
+		session := mux.NewSession(agentSide, true)
+		controlStream, err := session.Open()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for {
+				controlMessage, err := util.Read(controlStream)
+				if err != nil {
+					return
+				}
+				controlMessages <- controlMessage
+			}
+		}()
+
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer stream.Close()
+				if _, err := util.Read(stream); err == nil {
+					_, _ = io.Copy(stream, stream)
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		agentSide.Close()
+	})
+
+	requestMessage := message.BootstrapRequestMessage{
+		AgentId:   "ABC",
+		Multiplex: true,
+		Tunnels:   []message.TunnelRequest{{Name: "echo", Type: constants.TCP}},
+	}
+
+	proxyRegistry = registry.NewRegistryManager()
+	tunnelProxy, err := proxy.NewProxy(requestMessage, auth.Identity{AgentId: "ABC"}, serverSide, proxyRegistry, proxyRegistry.UnregisterChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyRegistry.Put(tunnelProxy)
+
+	return tunnelProxy.Tunnels["echo"], controlMessages
+}
+
+func dialEcho(t *testing.T, tunnel *proxy.Tunnel) net.Conn {
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(tunnel.PublicListenPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, buffer); err != nil || string(buffer) != "ping" {
+		t.Fatalf("expected echo of ping, got %q and %v", buffer, err)
+	}
+
+	return conn
+}
+
+func TestShutdownServerDrains(t *testing.T) {
+	tunnel, controlMessages := startEchoTunnel(t, "5s")
+	conn := dialEcho(t, tunnel)
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		shutdownServer()
+		close(done)
+	}()
+
+	for goAway := false; !goAway; {
+		select {
+		case controlMessage := <-controlMessages:
+			goAway = controlMessage.GetType() == message.GoAway
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected agent to be told the server goes away")
+		}
+	}
+
+	if _, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(tunnel.PublicListenPort))); err == nil {
+		t.Fatal("expected draining tunnel to stop accepting")
+	}
+
+	// the connection already joined keeps working while draining
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != "pong" {
+		t.Fatalf("expected echo of pong while draining, got %q and %v", buffer, err)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("expected shutdown to wait for the active connection")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected shutdown to complete once drained")
+	}
+
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Fatalf("expected shutdown before the drain timeout, took %s", elapsed)
+	}
+}
+
+func TestShutdownServerDrainTimeout(t *testing.T) {
+	tunnel, _ := startEchoTunnel(t, "300ms")
+	conn := dialEcho(t, tunnel)
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		shutdownServer()
+		close(done)
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected remaining connection to be closed after the drain timeout")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected shutdown to complete after the drain timeout")
+	}
+
+	if active := tunnel.ActiveConnections(); active != 0 {
+		t.Fatalf("expected no active connection, got %d", active)
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnel-transporter/config"
+	"tunnel-transporter/proxy"
+	"tunnel-transporter/status"
+)
+
+const statusHistorySize = 10
+
+var (
+	statusLock          sync.Mutex
+	agentState          = status.Connecting
+	connectedSince      time.Time
+	disconnectHistory   []status.Disconnect
+	bootstrapConnection *proxy.BootstrapConnection
+	failedAttempts      int
+	reconnectDelay      time.Duration
+	nextAttempt         time.Time
+)
+
+func setConnecting() {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	agentState = status.Connecting
+}
+
+// setConnected records the bootstrap connection, nil when the bootstrap failed.
+func setConnected(connection *proxy.BootstrapConnection) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	if connection == nil {
+		return
+	}
+
+	agentState = status.Connected
+	connectedSince = time.Now()
+	bootstrapConnection = connection
+	failedAttempts, reconnectDelay = 0, 0
+}
+
+// setReconnecting records the consecutive failed attempts and the delay before the next one.
+func setReconnecting(failures int, delay time.Duration) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	agentState = status.Reconnecting
+	failedAttempts, reconnectDelay = failures, delay
+	nextAttempt = time.Now().Add(delay)
+}
+
+// reconnectState returns the consecutive failed attempts and the delay before the next one,
+// both zero once connected.
+func reconnectState() (int, time.Duration) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	return failedAttempts, reconnectDelay
+}
+
+// setDisconnected records why the agent lost its connection, keeping the last statusHistorySize ones.
+func setDisconnected(err error) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	agentState = status.Disconnected
+	bootstrapConnection = nil
+
+	disconnectHistory = append(disconnectHistory, status.Disconnect{Time: time.Now(), Error: err.Error()})
+	if len(disconnectHistory) > statusHistorySize {
+		disconnectHistory = disconnectHistory[len(disconnectHistory)-statusHistorySize:]
+	}
+}
+
+func currentBootstrapConnection() *proxy.BootstrapConnection {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	return bootstrapConnection
+}
+
+func collectStatus() status.Status {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	agentStatus := status.Status{
+		AgentId:        config.Get().Agent.Id,
+		ServerEndpoint: config.Get().Agent.ServerEndpoint,
+		State:          agentState,
+		Reconnects:     atomic.LoadUint64(&agentReconnects),
+		History:        append([]status.Disconnect{}, disconnectHistory...),
+	}
+
+	if agentState == status.Reconnecting {
+		agentStatus.FailedAttempts = failedAttempts
+		agentStatus.NextAttempt = nextAttempt
+	}
+
+	publicEndpoints := map[string]status.Tunnel{}
+	activeConnections := map[string]int{}
+	if bootstrapConnection != nil {
+		agentStatus.ConnectedSince = connectedSince
+		agentStatus.RoundTripTime = bootstrapConnection.RoundTripTime()
+
+		for _, tunnel := range bootstrapConnection.Tunnels() {
+			publicEndpoints[tunnel.Name] = status.Tunnel{PublicPort: tunnel.PublicPort, Hosts: tunnel.Hosts}
+		}
+		activeConnections = bootstrapConnection.ActiveConnections()
+	}
+
+	for _, tunnel := range config.Get().Agent.Tunnels {
+		tunnelStatus := publicEndpoints[tunnel.Name]
+		tunnelStatus.Name = tunnel.Name
+		tunnelStatus.Type = tunnel.Type
+		tunnelStatus.LocalEndpoint = tunnel.LocalEndpoint
+		tunnelStatus.ActiveConnections = activeConnections[tunnel.Name]
+		agentStatus.Tunnels = append(agentStatus.Tunnels, tunnelStatus)
+	}
+
+	return agentStatus
+}
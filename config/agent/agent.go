@@ -1,11 +1,19 @@
 package agent
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"fmt"
 	"github.com/pkg/errors"
-	"io/ioutil"
+	"net"
+	"strings"
+	"time"
 	"tunnel-transporter/constants"
+	"tunnel-transporter/message"
+	"tunnel-transporter/status"
+	"tunnel-transporter/util"
 )
 
 var (
@@ -21,53 +29,257 @@ type Config struct {
 			Token string
 		} `yaml:"static-token"`
 
+		SignedToken struct {
+			Token string
+		} `yaml:"signed-token"`
+
 		Certificate struct {
-			caCertificatePath       string `yaml:"ca-certificate-path"`
-			agentCertificatePath    string `yaml:"agent-certificate-path"`
-			agentCertificateKeyPath string `yaml:"agent-certificate-key-path"`
+			CaCertificatePath       string `yaml:"ca-certificate-path"`
+			AgentCertificatePath    string `yaml:"agent-certificate-path"`
+			AgentCertificateKeyPath string `yaml:"agent-certificate-key-path"`
+		}
+	}
+	Transport struct {
+		Tls struct {
+			Enabled           bool
+			ServerName        string `yaml:"server-name"`
+			CaCertificatePath string `yaml:"ca-certificate-path"`
+			PinnedCertificate string `yaml:"pinned-certificate-sha256"`
+		}
+	}
+	ServerEndpoint string        `yaml:"server-endpoint"`
+	LocalEndpoint  string        `yaml:"local-endpoint"`
+	Multiplex      bool          `yaml:"multiplex"`
+	DrainTimeout   time.Duration `yaml:"drain-timeout"`
+	Reconnect      Reconnect     `yaml:"reconnect"`
+	Tunnels        []Tunnel      `yaml:"tunnels"`
+	Metrics        struct {
+		Port uint16
+	}
+	Status struct {
+		Address string
+	}
+}
+
+// Reconnect delays every attempt to reconnect to the server, from InitialDelay growing by
+// Multiplier up to MaxDelay and spread by Jitter, 0.2 when not set and none when set to zero.
+// The agent gives up after MaxAttempts consecutive failed attempts, zero retries forever.
+type Reconnect struct {
+	InitialDelay time.Duration `yaml:"initial-delay"`
+	MaxDelay     time.Duration `yaml:"max-delay"`
+	Multiplier   float64
+	Jitter       *float64
+	MaxAttempts  int `yaml:"max-attempts"`
+}
+
+type Tunnel struct {
+	Name          string
+	Type          constants.TunnelType
+	LocalEndpoint string `yaml:"local-endpoint"`
+	RemotePort    uint16 `yaml:"remote-port"`
+
+	CustomDomains []string `yaml:"custom-domains"`
+	Subdomain     string
+
+	Limits message.TunnelLimits
+}
+
+func (c *Config) GetTunnel(name string) (Tunnel, bool) {
+	for _, tunnel := range c.Tunnels {
+		if tunnel.Name == name {
+			return tunnel, true
 		}
 	}
-	ServerEndpoint string `yaml:"server-endpoint"`
-	LocalEndpoint  string `yaml:"local-endpoint"`
+
+	return Tunnel{}, false
 }
 
+func (r *Reconnect) validate() error {
+	if r.InitialDelay <= 0 {
+		r.InitialDelay = time.Second
+	}
+
+	if r.MaxDelay <= 0 {
+		r.MaxDelay = time.Minute
+	}
+
+	if r.Multiplier == 0 {
+		r.Multiplier = 2
+	}
+
+	if r.Jitter == nil {
+		jitter := 0.2
+		r.Jitter = &jitter
+	}
+
+	if r.MaxDelay < r.InitialDelay {
+		return errors.New("reconnect max-delay must not be less than initial-delay")
+	}
+
+	if r.Multiplier < 1 {
+		return errors.New("reconnect multiplier must be at least 1")
+	}
+
+	if *r.Jitter < 0 || *r.Jitter > 1 {
+		return errors.New("reconnect jitter must be between 0 and 1")
+	}
+
+	if r.MaxAttempts < 0 {
+		return errors.New("reconnect max-attempts must not be negative")
+	}
+
+	return nil
+}
+
+// CreateAgent validates the configuration, filling in defaults, and sets TlsConfig used by the
+// server connections. It runs once at startup, before any connection reads TlsConfig.
 func CreateAgent(agentConfig *Config) error {
+	tlsConfig, err := validate(agentConfig)
+	if err != nil {
+		return err
+	}
+
+	TlsConfig = tlsConfig
+	return nil
+}
+
+// ValidateAgent validates a reloaded configuration like CreateAgent without replacing the
+// TlsConfig of the running server connections, transport changes need a restart.
+func ValidateAgent(agentConfig *Config) error {
+	_, err := validate(agentConfig)
+	return err
+}
+
+func validate(agentConfig *Config) (*tls.Config, error) {
 	if agentConfig == nil {
-		return errors.New("missing agent configuration")
+		return nil, errors.New("missing agent configuration")
+	}
+
+	if len(agentConfig.Tunnels) == 0 && agentConfig.LocalEndpoint != "" {
+		agentConfig.Tunnels = []Tunnel{{
+			Name:          "default",
+			Type:          constants.TCP,
+			LocalEndpoint: agentConfig.LocalEndpoint,
+		}}
+	}
+
+	if agentConfig.DrainTimeout <= 0 {
+		agentConfig.DrainTimeout = 30 * time.Second
+	}
+
+	if err := agentConfig.Reconnect.validate(); err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for i := range agentConfig.Tunnels {
+		tunnel := &agentConfig.Tunnels[i]
+		if tunnel.Type == "" {
+			tunnel.Type = constants.TCP
+		}
+
+		if tunnel.Name == "" || names[tunnel.Name] {
+			return nil, errors.New(fmt.Sprintf("tunnel name %q must be unique and not blank", tunnel.Name))
+		}
+		names[tunnel.Name] = true
+	}
+
+	if agentConfig.Status.Address != "" {
+		if err := status.ValidateAddress(agentConfig.Status.Address); err != nil {
+			return nil, err
+		}
 	}
 
 	if agentConfig.Authentication.Type == constants.StaticToken {
 		if agentConfig.Authentication.StaticToken.Token == "" {
-			return errors.New("static-token authentication requires not blank token value")
+			return nil, errors.New("static-token authentication requires not blank token value")
 		}
 	}
 
-	if agentConfig.Authentication.Type == constants.Certificate {
-		cert, err := tls.LoadX509KeyPair(
-			agentConfig.Authentication.Certificate.agentCertificatePath,
-			agentConfig.Authentication.Certificate.agentCertificateKeyPath,
-		)
+	if agentConfig.Authentication.Type == constants.SignedToken {
+		if agentConfig.Authentication.SignedToken.Token == "" {
+			return nil, errors.New("signed-token authentication requires not blank token value")
+		}
+	}
+
+	if agentConfig.Transport.Tls.Enabled || agentConfig.Authentication.Type == constants.Certificate {
+		return createTlsConfig(agentConfig)
+	}
+
+	return nil, nil
+}
+
+// createTlsConfig builds the tls configuration of server connections. The server is verified
+// against the configured CA, or the system roots when none is set, and optionally pinned to
+// the sha256 fingerprint of its certificate. Certificate authentication adds the agent
+// certificate, whose common name becomes the agent id when none is configured.
+func createTlsConfig(agentConfig *Config) (*tls.Config, error) {
+	transportTls := agentConfig.Transport.Tls
+	authCertificate := agentConfig.Authentication.Certificate
+
+	serverName := transportTls.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(agentConfig.ServerEndpoint)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		serverName = host
+	}
 
-		caCertBytes, err := ioutil.ReadFile(agentConfig.Authentication.Certificate.caCertificatePath)
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	caCertificatePath := transportTls.CaCertificatePath
+	if caCertificatePath == "" && agentConfig.Authentication.Type == constants.Certificate {
+		caCertificatePath = authCertificate.CaCertificatePath
+	}
+
+	if caCertificatePath != "" {
+		certPool, err := util.LoadCertPool(caCertificatePath)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if transportTls.PinnedCertificate != "" {
+		pinnedFingerprint := strings.ToLower(strings.ReplaceAll(transportTls.PinnedCertificate, ":", ""))
+
+		// a pinned certificate is trusted on its own, e.g. a self-signed one, unless a CA is configured as well
+		tlsConfig.InsecureSkipVerify = caCertificatePath == ""
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server presented no certificate")
+			}
+
+			fingerprint := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(fingerprint[:]) != pinnedFingerprint {
+				return errors.New("server certificate does not match pinned fingerprint")
+			}
 
-		certPool := x509.NewCertPool()
-		ok := certPool.AppendCertsFromPEM(caCertBytes)
-		if !ok {
-			return errors.New("error while appending CA certificate to pool")
+			return nil
+		}
+	}
+
+	if agentConfig.Authentication.Type == constants.Certificate {
+		cert, err := tls.LoadX509KeyPair(authCertificate.AgentCertificatePath, authCertificate.AgentCertificateKeyPath)
+		if err != nil {
+			return nil, err
 		}
 
-		TlsConfig = &tls.Config{
-			Certificates:       []tls.Certificate{cert},
-			RootCAs:            certPool,
-			InsecureSkipVerify: true,
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if agentConfig.Id == "" {
+			agentConfig.Id = leaf.Subject.CommonName
 		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	return nil
+	return tlsConfig, nil
 }
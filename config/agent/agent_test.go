@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"gopkg.in/yaml.v2"
+	"reflect"
+	"testing"
+	"tunnel-transporter/constants"
+)
+
+func TestCreateAgentTunnels(t *testing.T) {
+	cases := []struct {
+		content string
+		tunnels []Tunnel
+		valid   bool
+	}{
+		{
+			"local-endpoint: 127.0.0.1:22",
+			[]Tunnel{{Name: "default", Type: constants.TCP, LocalEndpoint: "127.0.0.1:22"}},
+			true,
+		},
+		{
+			"local-endpoint: 127.0.0.1:22\ntunnels: [{name: ssh, local-endpoint: 127.0.0.1:2222}]",
+			[]Tunnel{{Name: "ssh", Type: constants.TCP, LocalEndpoint: "127.0.0.1:2222"}},
+			true,
+		},
+		{
+			"tunnels: [{name: ssh, local-endpoint: 127.0.0.1:22, remote-port: 10022}, {name: web, type: http, local-endpoint: 127.0.0.1:80, subdomain: web}]",
+			[]Tunnel{
+				{Name: "ssh", Type: constants.TCP, LocalEndpoint: "127.0.0.1:22", RemotePort: 10022},
+				{Name: "web", Type: constants.HTTP, LocalEndpoint: "127.0.0.1:80", Subdomain: "web"},
+			},
+			true,
+		},
+		{"tunnels: [{name: ssh}, {name: ssh, type: udp}]", nil, false},
+		{"tunnels: [{local-endpoint: 127.0.0.1:22}]", nil, false},
+	}
+
+	for _, c := range cases {
+		agentConfig := &Config{}
+		if err := yaml.Unmarshal([]byte(c.content), agentConfig); err != nil {
+			t.Fatal(err)
+		}
+
+		err := CreateAgent(agentConfig)
+		if (err == nil) != c.valid {
+			t.Fatalf("expected %q to be valid %t, got %v", c.content, c.valid, err)
+		}
+
+		if c.valid && !reflect.DeepEqual(agentConfig.Tunnels, c.tunnels) {
+			t.Fatalf("expected %q to define tunnels %+v, got %+v", c.content, c.tunnels, agentConfig.Tunnels)
+		}
+	}
+}
+
+func TestReconnectJitter(t *testing.T) {
+	cases := []struct {
+		content string
+		jitter  float64
+		valid   bool
+	}{
+		{"multiplier: 2", 0.2, true},
+		{"jitter: 0", 0, true},
+		{"jitter: 0.5", 0.5, true},
+		{"jitter: 1.5", 0, false},
+		{"jitter: -0.1", 0, false},
+	}
+
+	for _, c := range cases {
+		reconnect := Reconnect{}
+		if err := yaml.Unmarshal([]byte(c.content), &reconnect); err != nil {
+			t.Fatal(err)
+		}
+
+		err := reconnect.validate()
+		if (err == nil) != c.valid {
+			t.Fatalf("expected %q to be valid %t, got %v", c.content, c.valid, err)
+		}
+
+		if c.valid && *reconnect.Jitter != c.jitter {
+			t.Fatalf("expected %q to jitter by %v, got %v", c.content, c.jitter, *reconnect.Jitter)
+		}
+	}
+}
@@ -3,14 +3,15 @@ package config
 import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"sync/atomic"
 	"tunnel-transporter/config/agent"
 	"tunnel-transporter/config/log"
 	"tunnel-transporter/config/server"
+	"tunnel-transporter/constants"
 )
 
-var (
-	ClientConfig *Config
-)
+// current holds the *Config in use, a reload stores a new one instead of changing it in place.
+var current atomic.Value
 
 type Config struct {
 	Log    log.Config `yaml:"log"`
@@ -18,25 +19,49 @@ type Config struct {
 	Agent  agent.Config
 }
 
-func ParseConfig(configPath string) error {
-	bytes, err := ioutil.ReadFile(configPath)
+// ParseConfig loads the yaml configuration and applies the sections used by the given mode.
+func ParseConfig(configPath string, mode constants.Mode) error {
+	clientConfig, err := ReadConfig(configPath)
 	if err != nil {
 		return err
 	}
 
-	ClientConfig = &Config{}
-	if err = yaml.Unmarshal(bytes, ClientConfig); err != nil {
-		return err
+	current.Store(clientConfig)
+	return applyConfig(clientConfig, mode)
+}
+
+// Get returns the configuration in use. It is never modified, a reload replaces it as a whole.
+func Get() *Config {
+	clientConfig, _ := current.Load().(*Config)
+	return clientConfig
+}
+
+// ReadConfig loads the yaml configuration without validating or applying it.
+func ReadConfig(configPath string) (*Config, error) {
+	bytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
 	}
 
-	_ = applyConfig(ClientConfig)
+	clientConfig := &Config{}
+	if err = yaml.Unmarshal(bytes, clientConfig); err != nil {
+		return nil, err
+	}
 
-	return nil
+	return clientConfig, nil
 }
 
-func applyConfig(clientConfig *Config) error {
-	log.CreateLogger(&clientConfig.Log)
-	_ = server.CreateServer(&clientConfig.Server)
-	_ = agent.CreateAgent(&clientConfig.Agent)
+func applyConfig(clientConfig *Config, mode constants.Mode) error {
+	if err := log.CreateLogger(&clientConfig.Log); err != nil {
+		return err
+	}
+
+	switch mode {
+	case constants.ServerMode:
+		return server.CreateServer(&clientConfig.Server)
+	case constants.AgentMode:
+		return agent.CreateAgent(&clientConfig.Agent)
+	}
+
 	return nil
 }
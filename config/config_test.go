@@ -0,0 +1,283 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"tunnel-transporter/config/agent"
+	"tunnel-transporter/config/server"
+	"tunnel-transporter/constants"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	path        string
+	keyPath     string
+}
+
+// newCertificate writes a certificate for the common name signed by the issuer, or a CA
+// certificate when issuer is nil, and its key as PEM files.
+func newCertificate(t *testing.T, commonName string, issuer *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, parentKey := template, key
+	if issuer == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = issuer.certificate, issuer.key
+	}
+
+	certificateBytes, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, _ := x509.ParseCertificate(certificateBytes)
+	created := &testCertificate{
+		certificate: certificate,
+		key:         key,
+		path:        filepath.Join(t.TempDir(), "certificate.pem"),
+		keyPath:     filepath.Join(t.TempDir(), "key.pem"),
+	}
+	writeConfig(t, created.path, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateBytes})))
+	writeConfig(t, created.keyPath, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})))
+
+	return created
+}
+
+// handshake runs a tls handshake between the server and the agent configurations over loopback.
+func handshake(t *testing.T, serverConfig *tls.Config, agentConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+
+		tlsConn := tls.Server(conn, serverConfig)
+		if err = tlsConn.Handshake(); err == nil {
+			// the agent certificate is only verified once the server reads after the handshake
+			_, err = tlsConn.Write([]byte{1})
+		}
+		serverErr <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, agentConfig)
+	if err = tlsConn.Handshake(); err == nil {
+		_, err = tlsConn.Read(make([]byte, 1))
+	}
+	if err != nil {
+		return err
+	}
+
+	return <-serverErr
+}
+
+func TestParseConfigMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	writeConfig(t, path, "server:\n  port: 18080\nagent:\n  tunnels: [{name: ssh}, {name: ssh}]\n")
+
+	if err := ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatalf("expected server mode to ignore the agent section, got %v", err)
+	}
+
+	if Get().Server.ConnectionTimeout == 0 {
+		t.Fatal("expected server defaults to be filled")
+	}
+
+	if err := ParseConfig(path, constants.AgentMode); err == nil {
+		t.Fatal("expected agent mode to validate the agent section")
+	}
+
+	writeConfig(t, path, "server:\n  authentication:\n    type: certificate\nagent:\n  server-endpoint: 127.0.0.1:18080\n  local-endpoint: 127.0.0.1:22\n")
+	if err := ParseConfig(path, constants.AgentMode); err != nil {
+		t.Fatalf("expected agent mode to ignore the server section, got %v", err)
+	}
+
+	if err := ParseConfig(path, constants.ServerMode); err == nil {
+		t.Fatal("expected server mode to validate the server section")
+	}
+}
+
+func TestCertificateAuthentication(t *testing.T) {
+	ca := newCertificate(t, "tunnel-transporter CA", nil)
+	serverCertificate := newCertificate(t, "localhost", ca)
+	agentCertificate := newCertificate(t, "ABC", ca)
+
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	writeConfig(t, path, `
+server:
+  port: 18080
+  authentication:
+    type: certificate
+    certificate:
+      ca-certificate-path: `+ca.path+`
+      server-certificate-path: `+serverCertificate.path+`
+      server-certificate-key-path: `+serverCertificate.keyPath+`
+agent:
+  server-endpoint: localhost:18080
+  local-endpoint: 127.0.0.1:22
+  authentication:
+    type: certificate
+    certificate:
+      ca-certificate-path: `+ca.path+`
+      agent-certificate-path: `+agentCertificate.path+`
+      agent-certificate-key-path: `+agentCertificate.keyPath+`
+`)
+
+	if err := ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.TlsConfig == nil || server.TlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatal("expected server to require agent certificates")
+	}
+
+	if err := ParseConfig(path, constants.AgentMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if Get().Agent.Id != "ABC" {
+		t.Fatalf("expected agent id from certificate common name, got %s", Get().Agent.Id)
+	}
+
+	if err := handshake(t, server.TlsConfig, agent.TlsConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	withoutCertificate := agent.TlsConfig.Clone()
+	withoutCertificate.Certificates = nil
+	if err := handshake(t, server.TlsConfig, withoutCertificate); err == nil {
+		t.Fatal("expected agent without certificate to be refused")
+	}
+
+	otherCa := newCertificate(t, "other CA", nil)
+	otherCertificate := newCertificate(t, "ABC", otherCa)
+	otherCertificatePair, err := tls.LoadX509KeyPair(otherCertificate.path, otherCertificate.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	untrusted := agent.TlsConfig.Clone()
+	untrusted.Certificates = []tls.Certificate{otherCertificatePair}
+	if err := handshake(t, server.TlsConfig, untrusted); err == nil {
+		t.Fatal("expected agent certificate of another CA to be refused")
+	}
+}
+
+func TestTransportTls(t *testing.T) {
+	ca := newCertificate(t, "tunnel-transporter CA", nil)
+	serverCertificate := newCertificate(t, "localhost", ca)
+	fingerprint := sha256.Sum256(serverCertificate.certificate.Raw)
+	pinned := hex.EncodeToString(fingerprint[:])
+
+	var colonPinned []string
+	for i := 0; i < len(pinned); i += 2 {
+		colonPinned = append(colonPinned, strings.ToUpper(pinned[i:i+2]))
+	}
+
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	writeConfig(t, path, `
+server:
+  port: 18080
+  authentication:
+    type: static-token
+    static-token:
+      token: secret
+  transport:
+    tls:
+      enabled: true
+      certificate-path: `+serverCertificate.path+`
+      certificate-key-path: `+serverCertificate.keyPath+`
+`)
+	if err := ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.TlsConfig == nil || server.TlsConfig.ClientAuth != tls.NoClientCert {
+		t.Fatal("expected transport tls not to require agent certificates")
+	}
+
+	cases := []struct {
+		description string
+		tls         string
+		valid       bool
+	}{
+		{"configured CA", "ca-certificate-path: " + ca.path, true},
+		{"pinned certificate", "pinned-certificate-sha256: " + pinned, true},
+		{"pinned certificate with colons", "pinned-certificate-sha256: " + strings.Join(colonPinned, ":"), true},
+		{"configured CA and pinned certificate", "ca-certificate-path: " + ca.path + "\n      pinned-certificate-sha256: " + pinned, true},
+		{"system roots", "server-name: localhost", false},
+		{"other server name", "ca-certificate-path: " + ca.path + "\n      server-name: other.example.com", false},
+		{"other pinned certificate", "pinned-certificate-sha256: " + strings.Repeat("0", 64), false},
+	}
+
+	for _, c := range cases {
+		writeConfig(t, path, `
+agent:
+  server-endpoint: localhost:18080
+  local-endpoint: 127.0.0.1:22
+  authentication:
+    type: static-token
+    static-token:
+      token: secret
+  transport:
+    tls:
+      enabled: true
+      `+c.tls+`
+`)
+		if err := ParseConfig(path, constants.AgentMode); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := handshake(t, server.TlsConfig, agent.TlsConfig); (err == nil) != c.valid {
+			t.Fatalf("expected handshake with %s to succeed %t, got %v", c.description, c.valid, err)
+		}
+	}
+}
@@ -1,44 +1,124 @@
 package log
 
 import (
+	"fmt"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	TextFormat = "text"
+	JsonFormat = "json"
+
+	StderrOutput = "stderr"
+	FileOutput   = "file"
+)
+
+// output is the log file currently written, closed when the logger is created again.
+var output io.Closer
+
 type Config struct {
-	Level string `yaml:"level"`
+	Level  string     `yaml:"level"`
+	Format string     `yaml:"format"`
+	Output string     `yaml:"output"`
+	File   FileConfig `yaml:"file"`
+}
+
+// FileConfig rotates the log file once it reaches MaxSize megabytes or after RotateInterval,
+// keeping at most MaxBackups backups no older than MaxBackupAge. Zero disables a limit.
+type FileConfig struct {
+	Path           string        `yaml:"path"`
+	MaxSize        int64         `yaml:"max-size"`
+	RotateInterval time.Duration `yaml:"rotate-interval"`
+	MaxBackups     int           `yaml:"max-backups"`
+	MaxBackupAge   time.Duration `yaml:"max-backup-age"`
 }
 
-func CreateLogger(logConfig *Config) {
-	log.SetFormatter(&log.TextFormatter{
-		ForceColors:               true,
-		DisableColors:             false,
-		ForceQuote:                false,
-		DisableQuote:              true,
-		EnvironmentOverrideColors: false,
-		DisableTimestamp:          false,
-		FullTimestamp:             true,
-		TimestampFormat:           "2006-01-02 15:04:05",
-		DisableSorting:            false,
-		SortingFunc:               nil,
-		DisableLevelTruncation:    false,
-		PadLevelText:              false,
-		QuoteEmptyFields:          false,
-		CallerPrettyfier: func(f *runtime.Frame) (string, string) {
-			file := f.File + ":" + strconv.Itoa(f.Line)
-			var filename string
-			if fileLength := len(file); fileLength < 40 {
-				filename = file + strings.Repeat(" ", 40-fileLength)
-			} else {
-				filename = file[fileLength-40:]
-			}
-
-			return " [" + filename + "] ", ""
-		},
-	})
+func CreateLogger(logConfig *Config) error {
+	if logConfig.Format == "" {
+		logConfig.Format = TextFormat
+	}
+
+	if logConfig.Output == "" {
+		logConfig.Output = StderrOutput
+	}
+
+	var formatter log.Formatter
+	switch logConfig.Format {
+	case TextFormat:
+		formatter = &log.TextFormatter{
+			ForceColors:               logConfig.Output == StderrOutput,
+			DisableColors:             logConfig.Output != StderrOutput,
+			ForceQuote:                false,
+			DisableQuote:              true,
+			EnvironmentOverrideColors: false,
+			DisableTimestamp:          false,
+			FullTimestamp:             true,
+			TimestampFormat:           "2006-01-02 15:04:05",
+			DisableSorting:            false,
+			SortingFunc:               nil,
+			DisableLevelTruncation:    false,
+			PadLevelText:              false,
+			QuoteEmptyFields:          false,
+			CallerPrettyfier: func(f *runtime.Frame) (string, string) {
+				file := f.File + ":" + strconv.Itoa(f.Line)
+				var filename string
+				if fileLength := len(file); fileLength < 40 {
+					filename = file + strings.Repeat(" ", 40-fileLength)
+				} else {
+					filename = file[fileLength-40:]
+				}
+
+				return " [" + filename + "] ", ""
+			},
+		}
+	case JsonFormat:
+		formatter = &log.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+			CallerPrettyfier: func(f *runtime.Frame) (string, string) {
+				return "", f.File + ":" + strconv.Itoa(f.Line)
+			},
+		}
+	default:
+		return errors.New(fmt.Sprintf("unsupported log format %s, expecting text or json", logConfig.Format))
+	}
+
+	var writer io.Writer
+	switch logConfig.Output {
+	case StderrOutput:
+		writer = os.Stderr
+	case FileOutput:
+		if logConfig.File.Path == "" {
+			return errors.New("file log output requires not blank path")
+		}
+
+		file, err := newRotatingFile(logConfig.File)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error opening log file %s", logConfig.File.Path))
+		}
+		writer = file
+	default:
+		return errors.New(fmt.Sprintf("unsupported log output %s, expecting stderr or file", logConfig.Output))
+	}
+
+	log.SetFormatter(formatter)
 	log.SetReportCaller(true)
+	log.SetOutput(writer)
+
+	previous := output
+	output = nil
+	if file, ok := writer.(*rotatingFile); ok {
+		output = file
+	}
+	if previous != nil {
+		_ = previous.Close()
+	}
 
 	switch logConfig.Level {
 	case "trace":
@@ -56,4 +136,6 @@ func CreateLogger(logConfig *Config) {
 	case "panic":
 		log.SetLevel(log.PanicLevel)
 	}
+
+	return nil
 }
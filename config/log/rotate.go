@@ -0,0 +1,143 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile appends to the log file and moves it aside to a timestamped backup once it
+// would exceed maxSize bytes or was opened longer than interval ago. Backups beyond
+// maxBackups, or older than maxBackupAge, are removed on rotation. Zero disables a limit.
+type rotatingFile struct {
+	lock sync.Mutex
+
+	path         string
+	maxSize      int64
+	interval     time.Duration
+	maxBackups   int
+	maxBackupAge time.Duration
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(fileConfig FileConfig) (*rotatingFile, error) {
+	rotating := &rotatingFile{
+		path:         fileConfig.Path,
+		maxSize:      fileConfig.MaxSize * 1024 * 1024,
+		interval:     fileConfig.RotateInterval,
+		maxBackups:   fileConfig.MaxBackups,
+		maxBackupAge: fileConfig.MaxBackupAge,
+	}
+
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+
+	return rotating, nil
+}
+
+func (r *rotatingFile) Write(buffer []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(buffer)) > r.maxSize) || (r.interval > 0 && time.Since(r.opened) >= r.interval)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(buffer)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.file.Close()
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(r.path, r.backupPath(time.Now())); err != nil {
+		return err
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.prune()
+	return nil
+}
+
+// backupPath inserts the rotation time before the extension, e.g. tunnel-2006-01-02T15-04-05.000.log.
+func (r *rotatingFile) backupPath(rotated time.Time) string {
+	extension := filepath.Ext(r.path)
+	return strings.TrimSuffix(r.path, extension) + "-" + rotated.Format(backupTimeFormat) + extension
+}
+
+func (r *rotatingFile) prune() {
+	extension := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(r.path, extension) + "-"
+
+	paths, _ := filepath.Glob(prefix + "*" + extension)
+
+	type backup struct {
+		path    string
+		rotated time.Time
+	}
+	var backups []backup
+	for _, path := range paths {
+		rotated, err := time.ParseInLocation(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(path, prefix), extension), time.Local)
+		if err == nil {
+			backups = append(backups, backup{path: path, rotated: rotated})
+		}
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].rotated.After(backups[j].rotated)
+	})
+
+	for i, backup := range backups {
+		tooMany := r.maxBackups > 0 && i >= r.maxBackups
+		tooOld := r.maxBackupAge > 0 && time.Since(backup.rotated) > r.maxBackupAge
+		if tooMany || tooOld {
+			_ = os.Remove(backup.path)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package log
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.log")
+	file, err := newRotatingFile(FileConfig{Path: path, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.maxSize = 10
+
+	for i := 0; i < 4; i++ {
+		if _, err = file.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "tunnel-*.log"))
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups kept, got %v", backups)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+	if string(content) != "0123456789" {
+		t.Fatalf("expected the last write in the current file, got %q", content)
+	}
+}
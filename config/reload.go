@@ -0,0 +1,124 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"tunnel-transporter/config/agent"
+	"tunnel-transporter/config/log"
+	"tunnel-transporter/config/server"
+	"tunnel-transporter/constants"
+)
+
+// restartFields lists by yaml path the settings of each mode which are only read at startup,
+// every other setting is read again by the next connection, tunnel or handshake using it.
+var restartFields = map[constants.Mode][]string{
+	constants.ServerMode: {
+		"server.port",
+		"server.http.port",
+		"server.https.port",
+		"server.authentication.type",
+		"server.authentication.certificate",
+		"server.authentication.credentials",
+		"server.traffic",
+		"server.access-control",
+		"server.access-log",
+		"server.metrics",
+		"server.admin",
+		"server.dashboard",
+		"server.transport",
+	},
+	constants.AgentMode: {
+		"agent.id",
+		"agent.server-endpoint",
+		"agent.multiplex",
+		"agent.authentication.type",
+		"agent.authentication.certificate",
+		"agent.transport",
+		"agent.metrics",
+		"agent.status",
+	},
+}
+
+// Reload reads and validates the configuration again and applies it in place of the one
+// returned by Get. Settings needing a restart keep their running value and are returned by
+// yaml path, an invalid configuration is rejected as a whole and leaves Get untouched.
+func Reload(configPath string, mode constants.Mode) (previous *Config, restart []string, err error) {
+	clientConfig, err := ReadConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch mode {
+	case constants.ServerMode:
+		err = server.ValidateServer(&clientConfig.Server)
+	case constants.AgentMode:
+		err = agent.ValidateAgent(&clientConfig.Agent)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previous = Get()
+	reloaded, running := reflect.ValueOf(clientConfig).Elem(), reflect.ValueOf(previous).Elem()
+	for _, path := range restartFields[mode] {
+		field, runningField := lookup(reloaded, path), lookup(running, path)
+		if !reflect.DeepEqual(field.Interface(), runningField.Interface()) {
+			restart = append(restart, path)
+			field.Set(runningField)
+		}
+	}
+
+	// tunnels are registered by the handshake, only their local endpoints are read per connection
+	if mode == constants.AgentMode && !sameTunnels(clientConfig.Agent.Tunnels, previous.Agent.Tunnels) {
+		restart = append(restart, "agent.tunnels")
+		clientConfig.Agent.Tunnels = previous.Agent.Tunnels
+	}
+
+	if err = log.CreateLogger(&clientConfig.Log); err != nil {
+		return nil, nil, err
+	}
+
+	current.Store(clientConfig)
+	return previous, restart, nil
+}
+
+// lookup finds the struct field at the dot separated yaml path, named by its yaml tag or by
+// its lower cased name like yaml does. The returned value is invalid when no field matches.
+func lookup(value reflect.Value, path string) reflect.Value {
+	for _, name := range strings.Split(path, ".") {
+		found := false
+		valueType := value.Type()
+		for i := 0; i < valueType.NumField() && !found; i++ {
+			fieldName := strings.Split(valueType.Field(i).Tag.Get("yaml"), ",")[0]
+			if fieldName == "" {
+				fieldName = strings.ToLower(valueType.Field(i).Name)
+			}
+
+			if fieldName == name {
+				value, found = value.Field(i), true
+			}
+		}
+
+		if !found {
+			return reflect.Value{}
+		}
+	}
+
+	return value
+}
+
+func sameTunnels(tunnels []agent.Tunnel, others []agent.Tunnel) bool {
+	if len(tunnels) != len(others) {
+		return false
+	}
+
+	for i := range tunnels {
+		tunnel, other := tunnels[i], others[i]
+		tunnel.LocalEndpoint, other.LocalEndpoint = "", ""
+		if !reflect.DeepEqual(tunnel, other) {
+			return false
+		}
+	}
+
+	return true
+}
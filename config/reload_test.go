@@ -0,0 +1,61 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"tunnel-transporter/constants"
+)
+
+func writeConfig(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestartFieldsExist(t *testing.T) {
+	config := reflect.ValueOf(Config{})
+	for mode, paths := range restartFields {
+		for _, path := range paths {
+			if !lookup(config, path).IsValid() {
+				t.Fatalf("unknown %s restart setting %s", mode, path)
+			}
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	writeConfig(t, path, "log:\n  level: info\nserver:\n  port: 18080\n")
+	if err := ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(t, path, "log:\n  level: debug\nserver:\n  port: 18081\n  allowed-ports: [15000-15100]\n")
+	previous, restart, err := Reload(path, constants.ServerMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(restart, []string{"server.port"}) {
+		t.Fatalf("expected server.port to need a restart, got %v", restart)
+	}
+
+	if previous.Log.Level != "info" || Get().Log.Level != "debug" {
+		t.Fatalf("expected log level applied, got %s", Get().Log.Level)
+	}
+
+	if Get().Server.Port != 18080 || len(Get().Server.AllowedPorts) != 1 {
+		t.Fatalf("expected running port kept and allowed ports applied, got %+v", Get().Server)
+	}
+
+	writeConfig(t, path, "server:\n  admin:\n    port: 19000\n")
+	if _, _, err = Reload(path, constants.ServerMode); err == nil {
+		t.Fatal("expected invalid configuration rejected")
+	}
+
+	if Get().Log.Level != "debug" {
+		t.Fatal("expected running configuration kept")
+	}
+}
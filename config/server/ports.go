@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// PortRanges accepts either a yaml list or a comma separated string of single ports
+// and inclusive ranges, e.g. "10000-10100,20000". An empty value allows every port.
+type PortRanges []PortRange
+
+func (p *PortRanges) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var values []string
+	if err := unmarshal(&values); err != nil {
+		var value string
+		if err = unmarshal(&value); err != nil {
+			return err
+		}
+		values = []string{value}
+	}
+
+	ranges, err := ParsePortRanges(strings.Join(values, ","))
+	if err != nil {
+		return err
+	}
+
+	*p = ranges
+	return nil
+}
+
+// ParsePortRanges parses a comma separated string of single ports and inclusive ranges.
+func ParsePortRanges(value string) (PortRanges, error) {
+	ranges := PortRanges{}
+	for _, value := range strings.Split(value, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		portRange, err := parsePortRange(value)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, portRange)
+	}
+
+	return ranges, nil
+}
+
+func parsePortRange(value string) (PortRange, error) {
+	bounds := strings.SplitN(value, "-", 2)
+
+	from, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+	if err != nil || from == 0 {
+		return PortRange{}, errors.New(fmt.Sprintf("invalid port range %q", value))
+	}
+
+	to := from
+	if len(bounds) == 2 {
+		to, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16)
+		if err != nil || to < from {
+			return PortRange{}, errors.New(fmt.Sprintf("invalid port range %q", value))
+		}
+	}
+
+	return PortRange{From: uint16(from), To: uint16(to)}, nil
+}
+
+func (p PortRanges) Contains(port uint16) bool {
+	if len(p) == 0 {
+		return true
+	}
+
+	for _, portRange := range p {
+		if port >= portRange.From && port <= portRange.To {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p PortRanges) Size() int {
+	size := 0
+	for _, portRange := range p {
+		size += int(portRange.To-portRange.From) + 1
+	}
+
+	return size
+}
+
+// Port returns the n-th port across all ranges, n must be lower than Size.
+func (p PortRanges) Port(n int) uint16 {
+	for _, portRange := range p {
+		size := int(portRange.To-portRange.From) + 1
+		if n < size {
+			return portRange.From + uint16(n)
+		}
+		n -= size
+	}
+
+	return 0
+}
@@ -2,10 +2,11 @@ package server
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"github.com/pkg/errors"
-	"io/ioutil"
+	"time"
 	"tunnel-transporter/constants"
+	"tunnel-transporter/message"
+	"tunnel-transporter/util"
 )
 
 var (
@@ -13,59 +14,242 @@ var (
 )
 
 type Config struct {
-	Port           uint16
+	Port               uint16
+	ConnectionTimeout  time.Duration `yaml:"connection-timeout"`
+	UdpSessionTimeout  time.Duration `yaml:"udp-session-timeout"`
+	DrainTimeout       time.Duration `yaml:"drain-timeout"`
+	AllowedPorts       PortRanges    `yaml:"allowed-ports"`
+	PortReservationTtl time.Duration `yaml:"port-reservation-ttl"`
+	Http               struct {
+		Port          uint16
+		SubdomainHost string `yaml:"subdomain-host"`
+	}
+	Https struct {
+		Port          uint16
+		SubdomainHost string `yaml:"subdomain-host"`
+	}
 	Authentication struct {
 		Type constants.AuthenticationType
 
 		StaticToken struct {
-			Token string
+			Token        string
+			ReplayWindow time.Duration `yaml:"replay-window"`
 		} `yaml:"static-token"`
 
+		SignedToken struct {
+			Algorithm     string
+			Secret        string
+			PublicKeyPath string        `yaml:"public-key-path"`
+			ReplayWindow  time.Duration `yaml:"replay-window"`
+		} `yaml:"signed-token"`
+
 		Certificate struct {
-			caCertificatePath        string `yaml:"ca-certificate-path"`
-			serverCertificatePath    string `yaml:"server-certificate-path"`
-			serverCertificateKeyPath string `yaml:"server-certificate-key-path"`
+			CaCertificatePath        string `yaml:"ca-certificate-path"`
+			ServerCertificatePath    string `yaml:"server-certificate-path"`
+			ServerCertificateKeyPath string `yaml:"server-certificate-key-path"`
+		}
+
+		Credentials struct {
+			Path           string
+			ReloadInterval time.Duration `yaml:"reload-interval"`
+		}
+
+		Webhook struct {
+			Url               string
+			Timeout           time.Duration
+			CacheTtl          time.Duration `yaml:"cache-ttl"`
+			FailOpen          bool          `yaml:"fail-open"`
+			PublicConnections bool          `yaml:"public-connections"`
+		}
+	}
+	Limits        message.TunnelLimits
+	Traffic       Traffic
+	AccessControl struct {
+		Path           string
+		ReloadInterval time.Duration `yaml:"reload-interval"`
+	} `yaml:"access-control"`
+	AccessLog struct {
+		Path     string
+		Format   string
+		Template string
+	} `yaml:"access-log"`
+	Metrics struct {
+		Port uint16
+	}
+	Admin struct {
+		Port  uint16
+		Token string
+	}
+	Dashboard struct {
+		Port     uint16
+		Username string
+		Password string
+	}
+	Transport struct {
+		Tls struct {
+			Enabled            bool
+			CertificatePath    string `yaml:"certificate-path"`
+			CertificateKeyPath string `yaml:"certificate-key-path"`
+			CaCertificatePath  string `yaml:"ca-certificate-path"`
 		}
 	}
 }
 
+// CreateServer validates the configuration, filling in defaults, and sets TlsConfig used by the
+// agent connections. It runs once at startup, before any connection reads TlsConfig.
 func CreateServer(serverConfig *Config) error {
+	tlsConfig, err := validate(serverConfig)
+	if err != nil {
+		return err
+	}
+
+	TlsConfig = tlsConfig
+	return nil
+}
+
+// ValidateServer validates a reloaded configuration like CreateServer without replacing the
+// TlsConfig of the running agent connections, transport changes need a restart.
+func ValidateServer(serverConfig *Config) error {
+	_, err := validate(serverConfig)
+	return err
+}
+
+func validate(serverConfig *Config) (*tls.Config, error) {
 	if serverConfig == nil {
-		return errors.New("missing server configuration")
+		return nil, errors.New("missing server configuration")
+	}
+
+	if serverConfig.ConnectionTimeout <= 0 {
+		serverConfig.ConnectionTimeout = 10 * time.Second
+	}
+
+	if serverConfig.UdpSessionTimeout <= 0 {
+		serverConfig.UdpSessionTimeout = 60 * time.Second
+	}
+
+	if serverConfig.DrainTimeout <= 0 {
+		serverConfig.DrainTimeout = 30 * time.Second
+	}
+
+	if serverConfig.PortReservationTtl <= 0 {
+		serverConfig.PortReservationTtl = 24 * time.Hour
 	}
 
 	if serverConfig.Authentication.Type == constants.StaticToken {
-		if serverConfig.Authentication.StaticToken.Token == "" {
-			return errors.New("static-token authentication requires not blank token value")
+		if serverConfig.Authentication.StaticToken.Token == "" && serverConfig.Authentication.Credentials.Path == "" {
+			return nil, errors.New("static-token authentication requires not blank token value or credentials file")
 		}
 	}
 
-	if serverConfig.Authentication.Type == constants.Certificate {
-		cert, err := tls.LoadX509KeyPair(
-			serverConfig.Authentication.Certificate.serverCertificatePath,
-			serverConfig.Authentication.Certificate.serverCertificateKeyPath)
-		if err != nil {
-			return err
+	if serverConfig.Admin.Port != 0 && serverConfig.Admin.Token == "" {
+		return nil, errors.New("admin api requires not blank token value")
+	}
+
+	if serverConfig.Dashboard.Port != 0 && (serverConfig.Dashboard.Username == "" || serverConfig.Dashboard.Password == "") {
+		return nil, errors.New("dashboard requires not blank username and password")
+	}
+
+	if serverConfig.Authentication.StaticToken.ReplayWindow <= 0 {
+		serverConfig.Authentication.StaticToken.ReplayWindow = 30 * time.Second
+	}
+
+	if serverConfig.Authentication.SignedToken.ReplayWindow <= 0 {
+		serverConfig.Authentication.SignedToken.ReplayWindow = 30 * time.Second
+	}
+
+	if serverConfig.Authentication.Type == constants.SignedToken {
+		signedToken := serverConfig.Authentication.SignedToken
+		switch signedToken.Algorithm {
+		case "hmac":
+			if signedToken.Secret == "" {
+				return nil, errors.New("signed-token authentication with hmac requires not blank secret")
+			}
+		case "ed25519":
+			if signedToken.PublicKeyPath == "" {
+				return nil, errors.New("signed-token authentication with ed25519 requires public-key-path")
+			}
+
+			// the server can not sign with the public key, agents send their whole token over tls
+			if !serverConfig.Transport.Tls.Enabled {
+				return nil, errors.New("signed-token authentication with ed25519 requires transport tls")
+			}
+		default:
+			return nil, errors.New("signed-token authentication requires algorithm hmac or ed25519")
 		}
+	}
 
-		caCertBytes, err := ioutil.ReadFile(serverConfig.Authentication.Certificate.caCertificatePath)
-		if err != nil {
-			return err
+	if serverConfig.Authentication.Credentials.ReloadInterval <= 0 {
+		serverConfig.Authentication.Credentials.ReloadInterval = 10 * time.Second
+	}
+
+	if serverConfig.Authentication.Webhook.Timeout <= 0 {
+		serverConfig.Authentication.Webhook.Timeout = 3 * time.Second
+	}
+
+	if serverConfig.AccessControl.ReloadInterval <= 0 {
+		serverConfig.AccessControl.ReloadInterval = 10 * time.Second
+	}
+
+	if serverConfig.Traffic.SaveInterval <= 0 {
+		serverConfig.Traffic.SaveInterval = 30 * time.Second
+	}
+
+	if err := serverConfig.Traffic.validate(); err != nil {
+		return nil, err
+	}
+
+	if serverConfig.Transport.Tls.Enabled || serverConfig.Authentication.Type == constants.Certificate {
+		return createTlsConfig(serverConfig)
+	}
+
+	return nil, nil
+}
+
+// createTlsConfig builds the tls configuration of agent connections. Transport tls settings
+// take precedence, certificate authentication falls back to its own server certificate and
+// additionally requires every agent to present a client certificate signed by the CA.
+func createTlsConfig(serverConfig *Config) (*tls.Config, error) {
+	transportTls := serverConfig.Transport.Tls
+	authCertificate := serverConfig.Authentication.Certificate
+	isCertificateAuth := serverConfig.Authentication.Type == constants.Certificate
+
+	certificatePath, certificateKeyPath, caCertificatePath := transportTls.CertificatePath, transportTls.CertificateKeyPath, transportTls.CaCertificatePath
+	if isCertificateAuth {
+		if certificatePath == "" {
+			certificatePath, certificateKeyPath = authCertificate.ServerCertificatePath, authCertificate.ServerCertificateKeyPath
+		}
+
+		if authCertificate.CaCertificatePath != "" {
+			caCertificatePath = authCertificate.CaCertificatePath
 		}
+	}
 
-		certPool := x509.NewCertPool()
-		ok := certPool.AppendCertsFromPEM(caCertBytes)
-		if !ok {
-			return errors.New("error while appending CA certificate to pool")
+	cert, err := tls.LoadX509KeyPair(certificatePath, certificateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caCertificatePath != "" {
+		certPool, err := util.LoadCertPool(caCertificatePath)
+		if err != nil {
+			return nil, err
 		}
 
-		TlsConfig = &tls.Config{
-			Certificates:       []tls.Certificate{cert},
-			ClientCAs:          certPool,
-			InsecureSkipVerify: true,
-			ClientAuth:         tls.RequireAndVerifyClientCert,
+		tlsConfig.ClientCAs = certPool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if isCertificateAuth {
+		if tlsConfig.ClientCAs == nil {
+			return nil, errors.New("certificate authentication requires a CA certificate")
 		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
-	return nil
+	return tlsConfig, nil
 }
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DailyPeriod   = "daily"
+	MonthlyPeriod = "monthly"
+)
+
+// ByteSize accepts a number of bytes with an optional KB, MB, GB or TB suffix of powers of 1024.
+type ByteSize uint64
+
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+
+	size, err := ParseByteSize(value)
+	if err != nil {
+		return err
+	}
+
+	*b = size
+	return nil
+}
+
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := uint64(1)
+	for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = 1 << (10 * uint(i+1))
+			value = strings.TrimSpace(strings.TrimSuffix(value, suffix))
+			break
+		}
+	}
+	value = strings.TrimSuffix(value, "B")
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid byte size %q", value))
+	}
+
+	return ByteSize(number * float64(multiplier)), nil
+}
+
+// TrafficPolicy limits the upload, from public clients to the agent, and the download, from
+// the agent to public clients, in bytes per second, and the bytes transferred in both
+// directions per daily or monthly period. Zero values are unlimited.
+type TrafficPolicy struct {
+	Upload      ByteSize
+	Download    ByteSize
+	Quota       ByteSize
+	QuotaPeriod string `yaml:"quota-period"`
+}
+
+// Override returns the policy with every value set in other replaced.
+func (p TrafficPolicy) Override(other TrafficPolicy) TrafficPolicy {
+	if other.Upload != 0 {
+		p.Upload = other.Upload
+	}
+
+	if other.Download != 0 {
+		p.Download = other.Download
+	}
+
+	if other.Quota != 0 {
+		p.Quota = other.Quota
+	}
+
+	if other.QuotaPeriod != "" {
+		p.QuotaPeriod = other.QuotaPeriod
+	}
+
+	return p
+}
+
+func (p TrafficPolicy) validate() error {
+	switch p.QuotaPeriod {
+	case "", DailyPeriod, MonthlyPeriod:
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("quota-period must be %s or %s", DailyPeriod, MonthlyPeriod))
+}
+
+type AgentTraffic struct {
+	TrafficPolicy `yaml:",inline"`
+	Tunnels       map[string]TrafficPolicy
+}
+
+// Traffic holds the default policies of every agent and every tunnel, overridden per agent
+// and per tunnel of an agent.
+type Traffic struct {
+	StatePath    string        `yaml:"state-path"`
+	SaveInterval time.Duration `yaml:"save-interval"`
+
+	Agent  TrafficPolicy
+	Tunnel TrafficPolicy
+	Agents map[string]AgentTraffic
+}
+
+func (t Traffic) AgentPolicy(agentId string) TrafficPolicy {
+	return t.Agent.Override(t.Agents[agentId].TrafficPolicy)
+}
+
+func (t Traffic) TunnelPolicy(agentId string, tunnelName string) TrafficPolicy {
+	return t.Tunnel.Override(t.Agents[agentId].Tunnels[tunnelName])
+}
+
+func (t Traffic) validate() error {
+	policies := []TrafficPolicy{t.Agent, t.Tunnel}
+	for _, agent := range t.Agents {
+		policies = append(policies, agent.TrafficPolicy)
+		for _, tunnel := range agent.Tunnels {
+			policies = append(policies, tunnel)
+		}
+	}
+
+	for _, policy := range policies {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
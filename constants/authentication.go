@@ -5,5 +5,6 @@ type AuthenticationType string
 const (
 	None        AuthenticationType = "none"
 	StaticToken AuthenticationType = "static-token"
+	SignedToken AuthenticationType = "signed-token"
 	Certificate AuthenticationType = "certificate"
 )
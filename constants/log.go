@@ -0,0 +1,13 @@
+package constants
+
+// Structured log fields shared by the server and agent.
+const (
+	AgentIdField    = "agent_id"
+	TunnelField     = "tunnel"
+	PublicPortField = "public_port"
+	RemoteAddrField = "remote_addr"
+	ConnIdField     = "conn_id"
+	HostField       = "host"
+	HostsField      = "hosts"
+	SettingField    = "setting"
+)
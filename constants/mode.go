@@ -0,0 +1,8 @@
+package constants
+
+type Mode string
+
+const (
+	ServerMode Mode = "server"
+	AgentMode  Mode = "agent"
+)
@@ -0,0 +1,10 @@
+package constants
+
+type TunnelType string
+
+const (
+	TCP   TunnelType = "tcp"
+	HTTP  TunnelType = "http"
+	HTTPS TunnelType = "https"
+	UDP   TunnelType = "udp"
+)
@@ -0,0 +1,3 @@
+package constants
+
+const Version = "1.0"
@@ -0,0 +1,191 @@
+package dashboard
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+	"tunnel-transporter/admin"
+	"tunnel-transporter/registry"
+)
+
+const (
+	sampleInterval = 5 * time.Second
+	sampleCount    = 720
+	errorCount     = 100
+)
+
+//go:embed static
+var static embed.FS
+
+// Sample holds the throughput, in bytes per second, and the open public connections of the
+// tunnels at a point in time. Tunnels are keyed by "agent/tunnel".
+type Sample struct {
+	Time              time.Time
+	ActiveConnections int
+	BytesIn           float64
+	BytesOut          float64
+	Tunnels           map[string]TunnelSample
+}
+
+type TunnelSample struct {
+	ActiveConnections int
+	BytesIn           float64
+	BytesOut          float64
+}
+
+// LogEntry is a warning or error logged by the server.
+type LogEntry struct {
+	Time    time.Time
+	Level   string
+	Message string
+}
+
+type overview struct {
+	Agents  []admin.Agent
+	Samples []Sample
+	Errors  []LogEntry
+}
+
+// Dashboard serves a web ui of the agents and tunnels of the registry behind basic auth,
+// with throughput graphs from the samples taken every sampleInterval and the recent errors.
+type Dashboard struct {
+	registry *registry.Manager
+	username string
+	password string
+
+	samples *ring
+	errors  *ring
+	totals  map[string][2]uint64
+}
+
+func NewDashboard(manager *registry.Manager, username string, password string) *Dashboard {
+	dashboard := &Dashboard{
+		registry: manager,
+		username: username,
+		password: password,
+		samples:  newRing(sampleCount),
+		errors:   newRing(errorCount),
+		totals:   map[string][2]uint64{},
+	}
+	log.AddHook(&errorHook{errors: dashboard.errors})
+
+	return dashboard
+}
+
+// Serve samples the tunnels and serves the dashboard on the given port.
+func (d *Dashboard) Serve(port int) {
+	go d.sample()
+
+	log.WithField("port", port).Info("serving dashboard")
+	if err := http.ListenAndServe(":"+strconv.Itoa(port), d.Handler()); err != nil {
+		log.WithField("port", port).WithError(err).Error("error serving dashboard")
+	}
+}
+
+func (d *Dashboard) Handler() http.Handler {
+	assets, _ := fs.Sub(static, "static")
+
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/", http.FileServer(http.FS(assets)))
+	serveMux.HandleFunc("/api/overview", d.handleOverview)
+
+	return d.authenticate(serveMux)
+}
+
+func (d *Dashboard) authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		username, password, ok := request.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(d.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(d.password)) != 1 {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="tunnel-transporter"`)
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func (d *Dashboard) handleOverview(writer http.ResponseWriter, request *http.Request) {
+	current := overview{
+		Agents:  admin.Agents(d.registry),
+		Samples: []Sample{},
+		Errors:  []LogEntry{},
+	}
+	for _, sample := range d.samples.list() {
+		current.Samples = append(current.Samples, sample.(Sample))
+	}
+	for _, entry := range d.errors.list() {
+		current.Errors = append(current.Errors, entry.(LogEntry))
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(current); err != nil {
+		log.WithError(err).Error("error writing dashboard overview")
+	}
+}
+
+func (d *Dashboard) sample() {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.samples.push(d.takeSample(admin.Agents(d.registry), sampleInterval.Seconds()))
+	}
+}
+
+// takeSample computes the throughput of every tunnel since the previous sample, a tunnel
+// replaced by a reconnecting agent restarts from zero.
+func (d *Dashboard) takeSample(agents []admin.Agent, seconds float64) Sample {
+	sample := Sample{Time: time.Now(), Tunnels: map[string]TunnelSample{}}
+	totals := map[string][2]uint64{}
+
+	for _, agent := range agents {
+		for _, tunnel := range agent.Tunnels {
+			key := agent.Id + "/" + tunnel.Name
+			previous := d.totals[key]
+			totals[key] = [2]uint64{tunnel.BytesIn, tunnel.BytesOut}
+
+			tunnelSample := TunnelSample{
+				ActiveConnections: tunnel.ActiveConnections,
+				BytesIn:           float64(delta(tunnel.BytesIn, previous[0])) / seconds,
+				BytesOut:          float64(delta(tunnel.BytesOut, previous[1])) / seconds,
+			}
+			sample.Tunnels[key] = tunnelSample
+			sample.ActiveConnections += tunnelSample.ActiveConnections
+			sample.BytesIn += tunnelSample.BytesIn
+			sample.BytesOut += tunnelSample.BytesOut
+		}
+	}
+	d.totals = totals
+
+	return sample
+}
+
+func delta(current uint64, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+
+	return current - previous
+}
+
+// errorHook keeps the warnings and errors logged for the dashboard.
+type errorHook struct {
+	errors *ring
+}
+
+func (h *errorHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
+}
+
+func (h *errorHook) Fire(entry *log.Entry) error {
+	h.errors.push(LogEntry{Time: entry.Time, Level: entry.Level.String(), Message: entry.Message})
+	return nil
+}
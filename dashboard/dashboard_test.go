@@ -0,0 +1,56 @@
+package dashboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tunnel-transporter/admin"
+	"tunnel-transporter/registry"
+)
+
+func TestRing(t *testing.T) {
+	values := newRing(3)
+	for i := 1; i <= 4; i++ {
+		values.push(i)
+	}
+
+	list := values.list()
+	if len(list) != 3 || list[0] != 2 || list[2] != 4 {
+		t.Fatalf("expected oldest value dropped, got %v", list)
+	}
+}
+
+func TestTakeSample(t *testing.T) {
+	dashboard := NewDashboard(registry.NewRegistryManager(), "admin", "secret")
+	agents := func(bytesIn uint64) []admin.Agent {
+		return []admin.Agent{{Id: "ABC", Tunnels: []admin.Tunnel{{Name: "echo", BytesIn: bytesIn, ActiveConnections: 1}}}}
+	}
+
+	dashboard.takeSample(agents(1000), 5)
+	sample := dashboard.takeSample(agents(6000), 5)
+	if sample.BytesIn != 1000 || sample.Tunnels["ABC/echo"].BytesIn != 1000 || sample.ActiveConnections != 1 {
+		t.Fatalf("expected 1000 bytes per second, got %+v", sample)
+	}
+
+	if sample = dashboard.takeSample(agents(500), 5); sample.BytesIn != 100 {
+		t.Fatalf("expected replaced tunnel to restart from zero, got %+v", sample)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	server := httptest.NewServer(NewDashboard(registry.NewRegistryManager(), "admin", "secret").Handler())
+	defer server.Close()
+
+	for password, status := range map[string]int{"wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		request.SetBasicAuth("admin", password)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.StatusCode != status {
+			t.Fatalf("expected status %d with password %s, got %d", status, password, response.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package dashboard
+
+import (
+	"sync"
+)
+
+// ring keeps the last size values pushed, dropping the oldest.
+type ring struct {
+	lock   sync.Mutex
+	values []interface{}
+	next   int
+	full   bool
+}
+
+func newRing(size int) *ring {
+	return &ring{values: make([]interface{}, size)}
+}
+
+func (r *ring) push(value interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.values[r.next] = value
+	r.next = (r.next + 1) % len(r.values)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the values kept, oldest first.
+func (r *ring) list() []interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.full {
+		return append([]interface{}{}, r.values[:r.next]...)
+	}
+
+	return append(append([]interface{}{}, r.values[r.next:]...), r.values[:r.next]...)
+}
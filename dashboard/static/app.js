@@ -0,0 +1,183 @@
+(function () {
+    const refreshInterval = 5000;
+
+    const chart = document.getElementById("chart");
+    const series = document.getElementById("series");
+
+    function formatBytes(value) {
+        const units = ["B", "KB", "MB", "GB", "TB"];
+        let unit = 0;
+        while (value >= 1024 && unit < units.length - 1) {
+            value /= 1024;
+            unit++;
+        }
+        return value.toFixed(unit === 0 ? 0 : 1) + " " + units[unit];
+    }
+
+    function formatSince(since) {
+        const seconds = Math.floor((Date.now() - new Date(since).getTime()) / 1000);
+        if (seconds < 60) {
+            return seconds + "s";
+        }
+        if (seconds < 3600) {
+            return Math.floor(seconds / 60) + "m";
+        }
+        return Math.floor(seconds / 3600) + "h " + Math.floor(seconds % 3600 / 60) + "m";
+    }
+
+    function cell(row, text) {
+        const td = document.createElement("td");
+        td.textContent = text;
+        row.appendChild(td);
+    }
+
+    function renderAgents(agents) {
+        const body = document.getElementById("agents");
+        body.replaceChildren();
+
+        agents.forEach(function (agent) {
+            const tunnels = agent.Tunnels.length > 0 ? agent.Tunnels : [null];
+            tunnels.forEach(function (tunnel, index) {
+                const row = document.createElement("tr");
+                cell(row, index === 0 ? agent.Id : "");
+                cell(row, index === 0 ? agent.Version : "");
+                cell(row, index === 0 ? [agent.OS, agent.Arch].filter(Boolean).join("/") : "");
+                cell(row, index === 0 ? agent.RemoteAddr : "");
+                cell(row, index === 0 ? formatSince(agent.ConnectedSince) : "");
+                if (tunnel) {
+                    cell(row, tunnel.Name);
+                    cell(row, tunnel.Type);
+                    cell(row, tunnel.PublicPort ? String(tunnel.PublicPort) : (tunnel.Hosts || []).join(", "));
+                    cell(row, String(tunnel.ActiveConnections));
+                    cell(row, formatBytes(tunnel.BytesIn));
+                    cell(row, formatBytes(tunnel.BytesOut));
+                }
+                body.appendChild(row);
+            });
+        });
+    }
+
+    function renderSeries(agents) {
+        const selected = series.value;
+        const keys = [];
+        agents.forEach(function (agent) {
+            agent.Tunnels.forEach(function (tunnel) {
+                keys.push(agent.Id + "/" + tunnel.Name);
+            });
+        });
+
+        series.replaceChildren();
+        [""].concat(keys).forEach(function (key) {
+            const option = document.createElement("option");
+            option.value = key;
+            option.textContent = key || "all tunnels";
+            option.selected = key === selected;
+            series.appendChild(option);
+        });
+    }
+
+    function renderChart(samples) {
+        const key = series.value;
+        const points = samples.map(function (sample) {
+            const values = key ? (sample.Tunnels[key] || {BytesIn: 0, BytesOut: 0}) : sample;
+            return [values.BytesIn, values.BytesOut];
+        });
+
+        const context = chart.getContext("2d");
+        const width = chart.width, height = chart.height, padding = 24;
+        context.clearRect(0, 0, width, height);
+
+        const max = Math.max(1, ...points.map(function (point) {
+            return Math.max(point[0], point[1]);
+        }));
+
+        context.fillStyle = "#888";
+        context.font = "11px sans-serif";
+        context.fillText(formatBytes(max) + "/s", 4, 12);
+        context.strokeStyle = "#e5e7eb";
+        context.beginPath();
+        context.moveTo(0, height - padding);
+        context.lineTo(width, height - padding);
+        context.stroke();
+
+        [["#2f80ed", 0], ["#27ae60", 1]].forEach(function (line) {
+            context.strokeStyle = line[0];
+            context.beginPath();
+            points.forEach(function (point, index) {
+                const x = points.length > 1 ? index * width / (points.length - 1) : 0;
+                const y = height - padding - point[line[1]] / max * (height - 2 * padding);
+                if (index === 0) {
+                    context.moveTo(x, y);
+                } else {
+                    context.lineTo(x, y);
+                }
+            });
+            context.stroke();
+        });
+    }
+
+    function renderErrors(errors) {
+        const list = document.getElementById("errors");
+        list.replaceChildren();
+
+        errors.slice().reverse().forEach(function (entry) {
+            const item = document.createElement("li");
+            item.className = entry.Level;
+            item.textContent = new Date(entry.Time).toLocaleString() + " " + entry.Level.toUpperCase() + " " + entry.Message;
+            list.appendChild(item);
+        });
+
+        if (errors.length === 0) {
+            const item = document.createElement("li");
+            item.textContent = "No recent errors.";
+            list.appendChild(item);
+        }
+    }
+
+    function render(overview) {
+        let tunnels = 0, connections = 0;
+        overview.Agents.forEach(function (agent) {
+            tunnels += agent.Tunnels.length;
+            agent.Tunnels.forEach(function (tunnel) {
+                connections += tunnel.ActiveConnections;
+            });
+        });
+
+        const last = overview.Samples[overview.Samples.length - 1];
+        document.getElementById("agent-count").textContent = overview.Agents.length;
+        document.getElementById("tunnel-count").textContent = tunnels;
+        document.getElementById("connection-count").textContent = connections;
+        document.getElementById("throughput").textContent = formatBytes(last ? last.BytesIn + last.BytesOut : 0) + "/s";
+        document.getElementById("updated").textContent = "updated " + new Date().toLocaleTimeString();
+
+        renderAgents(overview.Agents);
+        renderSeries(overview.Agents);
+        renderChart(overview.Samples);
+        renderErrors(overview.Errors);
+    }
+
+    let latest = null;
+
+    function refresh() {
+        fetch("api/overview", {credentials: "same-origin"})
+            .then(function (response) {
+                return response.json();
+            })
+            .then(function (overview) {
+                latest = overview;
+                render(overview);
+            })
+            .catch(function (err) {
+                document.getElementById("updated").textContent = "update failed: " + err;
+            });
+    }
+
+    series.addEventListener("change", function () {
+        if (latest) {
+            renderChart(latest.Samples);
+        }
+    });
+
+    refresh();
+    setInterval(refresh, refreshInterval);
+})();
@@ -2,10 +2,15 @@ package main
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 	"os"
+	"time"
+	"tunnel-transporter/auth"
 	"tunnel-transporter/client"
 	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/status"
 )
 
 func main() {
@@ -20,7 +25,7 @@ func main() {
 	app := &cli.App{
 		Name:    "tunnel-transporter",
 		Usage:   "exposing proxy connections from public connections to local connections",
-		Version: "1.0",
+		Version: constants.Version,
 		Commands: []*cli.Command{
 			{
 				Name:        "server",
@@ -28,9 +33,10 @@ func main() {
 				Category:    "mode",
 				Flags:       []cli.Flag{configFileFlag},
 				Action: func(context *cli.Context) error {
-					if err := config.ParseConfig(context.String("file")); err != nil {
+					if err := config.ParseConfig(context.String("file"), constants.ServerMode); err != nil {
 						return err
 					}
+					go client.WatchConfig(context.String("file"), constants.ServerMode)
 					client.StartServer()
 					return nil
 				},
@@ -41,11 +47,43 @@ func main() {
 				Category:    "mode",
 				Flags:       []cli.Flag{configFileFlag},
 				Action: func(context *cli.Context) error {
-					if err := config.ParseConfig(context.String("file")); err != nil {
+					if err := config.ParseConfig(context.String("file"), constants.AgentMode); err != nil {
 						return err
 					}
-					client.StartAgent()
-					return nil
+					go client.WatchConfig(context.String("file"), constants.AgentMode)
+					return client.StartAgent()
+				},
+			},
+			{
+				Name:        "status",
+				Description: "print the state of the agent running with the configuration file, queried from its status api",
+				Category:    "tool",
+				Flags: []cli.Flag{
+					configFileFlag,
+					&cli.StringFlag{Name: "address", Usage: "status address of the agent, instead of agent.status.address of the configuration file"},
+				},
+				Action: printStatus,
+			},
+			{
+				Name:        "token",
+				Description: "manage signed agent tokens",
+				Category:    "tool",
+				Subcommands: []*cli.Command{
+					{
+						Name:        "issue",
+						Description: "issue a signed token for an agent from a local signing key",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "agent-id", Usage: "agent id the token is issued for", Required: true},
+							&cli.StringFlag{Name: "algorithm", Usage: "signing algorithm, hmac or ed25519", Value: auth.HmacAlgorithm},
+							&cli.StringFlag{Name: "secret", Usage: "hmac signing secret", EnvVars: []string{"TT_TOKEN_SECRET"}},
+							&cli.StringFlag{Name: "private-key-path", Usage: "ed25519 private key in PKCS #8 PEM format"},
+							&cli.DurationFlag{Name: "expires-in", Usage: "validity of the token, 0 never expires", Value: 24 * time.Hour},
+							&cli.StringFlag{Name: "ports", Usage: "allowed remote ports, e.g. 10000-10100,20000"},
+							&cli.StringSliceFlag{Name: "subdomains", Usage: "allowed subdomain, may be repeated"},
+							&cli.IntFlag{Name: "max-tunnels", Usage: "maximum number of tunnels, 0 is unlimited"},
+						},
+						Action: issueToken,
+					},
 				},
 			},
 		},
@@ -61,7 +99,68 @@ func main() {
 
 	err := app.Run(os.Args)
 	if err != nil {
-		fmt.Printf("error running tunnel-transporter, reason: %s", err)
-		return
+		fmt.Printf("error running tunnel-transporter, reason: %s\n", err)
+		os.Exit(1)
 	}
 }
+
+func printStatus(context *cli.Context) error {
+	address := context.String("address")
+	if address == "" {
+		clientConfig, err := config.ReadConfig(context.String("file"))
+		if err != nil {
+			return err
+		}
+
+		if address = clientConfig.Agent.Status.Address; address == "" {
+			return errors.New("agent status api is not configured, set agent.status.address or --address")
+		}
+	}
+
+	agentStatus, err := status.Fetch(address)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error querying agent status on %s", address))
+	}
+
+	status.Print(os.Stdout, agentStatus)
+	return nil
+}
+
+func issueToken(context *cli.Context) error {
+	var key *auth.SigningKey
+	switch context.String("algorithm") {
+	case auth.HmacAlgorithm:
+		if context.String("secret") == "" {
+			return errors.New("hmac signing requires --secret")
+		}
+		key = auth.NewHmacKey(context.String("secret"))
+	case auth.Ed25519Algorithm:
+		privateKey, err := auth.LoadEd25519PrivateKey(context.String("private-key-path"))
+		if err != nil {
+			return err
+		}
+		key = privateKey
+	default:
+		return errors.New(fmt.Sprintf("unsupported algorithm %s", context.String("algorithm")))
+	}
+
+	now := time.Now()
+	claims := auth.Claims{
+		AgentId:    context.String("agent-id"),
+		IssuedAt:   now.Unix(),
+		Ports:      context.String("ports"),
+		Subdomains: context.StringSlice("subdomains"),
+		MaxTunnels: context.Int("max-tunnels"),
+	}
+	if expiresIn := context.Duration("expires-in"); expiresIn > 0 {
+		claims.ExpiresAt = now.Add(expiresIn).Unix()
+	}
+
+	token, err := key.Issue(claims)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token)
+	return nil
+}
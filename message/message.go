@@ -3,6 +3,7 @@ package message
 import (
 	"encoding/json"
 	"github.com/pkg/errors"
+	"tunnel-transporter/constants"
 )
 
 type (
@@ -14,10 +15,13 @@ const (
 	Unknown                   Type = "Unknown"
 	Ping                      Type = "Ping"
 	Pong                      Type = "Pong"
+	AuthChallenge             Type = "AuthChallenge"
 	BootstrapRequest          Type = "BootstrapRequest"
 	BootstrapResponse         Type = "BootstrapResponse"
 	RequireConnectionRequest  Type = "RequireConnectionRequest"
 	RequireConnectionResponse Type = "RequireConnectionResponse"
+	StreamOpen                Type = "StreamOpen"
+	GoAway                    Type = "GoAway"
 )
 
 type RawMessage struct {
@@ -52,6 +56,8 @@ func Unpack(buffer []byte) (TypedMessage, error) {
 		message = &PingMessage{}
 	case Pong:
 		message = &PongMessage{}
+	case AuthChallenge:
+		message = &AuthChallengeMessage{}
 	case BootstrapRequest:
 		message = &BootstrapRequestMessage{}
 	case BootstrapResponse:
@@ -60,6 +66,10 @@ func Unpack(buffer []byte) (TypedMessage, error) {
 		message = &RequireNewConnectionRequestMessage{}
 	case RequireConnectionResponse:
 		message = &RequireNewConnectionResponseMessage{}
+	case StreamOpen:
+		message = &StreamOpenMessage{}
+	case GoAway:
+		message = &GoAwayMessage{}
 	default:
 		return nil, errors.New("unknown message type")
 	}
@@ -75,6 +85,7 @@ func Unpack(buffer []byte) (TypedMessage, error) {
 /*===Ping===*/
 
 type PingMessage struct {
+	Timestamp int64
 }
 
 func (p PingMessage) GetType() Type {
@@ -84,12 +95,23 @@ func (p PingMessage) GetType() Type {
 /*===Pong===*/
 
 type PongMessage struct {
+	Timestamp int64
 }
 
 func (p PongMessage) GetType() Type {
 	return Pong
 }
 
+/*===AuthChallenge===*/
+
+type AuthChallengeMessage struct {
+	Nonce string
+}
+
+func (a AuthChallengeMessage) GetType() Type {
+	return AuthChallenge
+}
+
 /*===BootstrapRequest===*/
 
 type BootstrapRequestMessage struct {
@@ -98,7 +120,12 @@ type BootstrapRequestMessage struct {
 	OS           string
 	Arch         string
 
-	StaticToken string
+	Timestamp int64
+	Proof     string
+	Token     string
+
+	Multiplex bool
+	Tunnels   []TunnelRequest
 }
 
 func (b BootstrapRequestMessage) GetType() Type {
@@ -107,8 +134,16 @@ func (b BootstrapRequestMessage) GetType() Type {
 
 /*===BootstrapResponse===*/
 
+// BootstrapResponseMessage answers the bootstrap request, Unauthorized tells an Error rejecting
+// the identity of the agent, which retrying the same credentials will not fix.
 type BootstrapResponseMessage struct {
-	Error string
+	Multiplex bool
+	Tunnels   []TunnelResponse
+
+	SessionNonce string
+
+	Error        string
+	Unauthorized bool
 }
 
 func (b BootstrapResponseMessage) GetType() Type {
@@ -118,6 +153,8 @@ func (b BootstrapResponseMessage) GetType() Type {
 /*===RequireConnectionRequest===*/
 
 type RequireNewConnectionRequestMessage struct {
+	ConnectionId string
+	TunnelName   string
 }
 
 func (r RequireNewConnectionRequestMessage) GetType() Type {
@@ -127,9 +164,11 @@ func (r RequireNewConnectionRequestMessage) GetType() Type {
 /*===RequireConnectionResponse===*/
 
 type RequireNewConnectionResponseMessage struct {
-	AgentId string
+	AgentId      string
+	ConnectionId string
 
-	StaticToken string
+	Timestamp int64
+	Proof     string
 
 	Error string
 }
@@ -137,3 +176,53 @@ type RequireNewConnectionResponseMessage struct {
 func (r RequireNewConnectionResponseMessage) GetType() Type {
 	return RequireConnectionResponse
 }
+
+/*===StreamOpen===*/
+
+type StreamOpenMessage struct {
+	TunnelName string
+}
+
+func (s StreamOpenMessage) GetType() Type {
+	return StreamOpen
+}
+
+/*===GoAway===*/
+
+// GoAwayMessage announces the sender is shutting down, no new connection is opened over the
+// control connection while the connections already joined are drained.
+type GoAwayMessage struct {
+	Reason string
+}
+
+func (g GoAwayMessage) GetType() Type {
+	return GoAway
+}
+
+/*===Tunnel===*/
+
+type TunnelRequest struct {
+	Name       string
+	Type       constants.TunnelType
+	RemotePort uint16
+
+	CustomDomains []string
+	Subdomain     string
+
+	Limits TunnelLimits
+}
+
+// TunnelLimits restrict the public connections of a tunnel, zero values are unlimited. Rate
+// is the number of new connections per second, refilling a bucket of Burst connections.
+type TunnelLimits struct {
+	MaxConnections      int     `yaml:"max-connections"`
+	MaxConnectionsPerIp int     `yaml:"max-connections-per-ip"`
+	Rate                float64 `yaml:"rate"`
+	Burst               int     `yaml:"burst"`
+}
+
+type TunnelResponse struct {
+	Name       string
+	PublicPort uint16
+	Hosts      []string
+}
@@ -36,3 +36,20 @@ func TestUnpack(t *testing.T) {
 
 	fmt.Println(recoveredMessage)
 }
+
+func TestUnpackGoAway(t *testing.T) {
+	packedBytes, err := Pack(GoAwayMessage{Reason: "server shutting down"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recoveredMessage, err := Unpack(packedBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goAwayMessage, ok := recoveredMessage.(*GoAwayMessage)
+	if !ok || goAwayMessage.Reason != "server shutting down" {
+		t.Fatalf("unexpected message %v", recoveredMessage)
+	}
+}
@@ -0,0 +1,261 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const namespace = "tunnel_transporter_"
+
+var (
+	DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	registry = &Registry{families: map[string]family{}}
+
+	labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+)
+
+type family interface {
+	write(writer io.Writer)
+}
+
+// Registry holds the metric families exposed in the prometheus text format.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]family
+}
+
+func (r *Registry) register(name string, metric family) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.families[name]; ok {
+		panic(errors.New(fmt.Sprintf("metric %s registered twice", name)))
+	}
+	r.families[name] = metric
+}
+
+// WriteText writes every registered family in the prometheus text exposition format.
+func WriteText(writer io.Writer) {
+	registry.lock.Lock()
+	names := make([]string, 0, len(registry.families))
+	for name := range registry.families {
+		names = append(names, name)
+	}
+	families := registry.families
+	registry.lock.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		families[name].write(writer)
+	}
+}
+
+type descriptor struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+}
+
+func newDescriptor(name string, help string, kind string, labelNames []string) descriptor {
+	return descriptor{name: namespace + name, help: help, kind: kind, labelNames: labelNames}
+}
+
+func (d descriptor) writeHeader(writer io.Writer) {
+	_, _ = fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "), d.name, d.kind)
+}
+
+func writeSample(writer io.Writer, name string, labelNames []string, labelValues []string, value float64) {
+	_, _ = io.WriteString(writer, name)
+	if len(labelNames) > 0 {
+		pairs := make([]string, len(labelNames))
+		for i, labelName := range labelNames {
+			pairs[i] = labelName + "=\"" + labelEscaper.Replace(labelValues[i]) + "\""
+		}
+		_, _ = io.WriteString(writer, "{"+strings.Join(pairs, ",")+"}")
+	}
+	_, _ = io.WriteString(writer, " "+formatValue(value)+"\n")
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+/*===Counter===*/
+
+type Counter struct {
+	labelValues []string
+	value       uint64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+type CounterVec struct {
+	descriptor
+
+	lock     sync.Mutex
+	children map[string]*Counter
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	vec := &CounterVec{
+		descriptor: newDescriptor(name, help, "counter", labelNames),
+		children:   map[string]*Counter{},
+	}
+	registry.register(vec.name, vec)
+	return vec
+}
+
+func NewCounter(name string, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// With returns the counter of the label values, given in the order of the label names.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	key := labelKey(labelValues)
+	counter, ok := v.children[key]
+	if !ok {
+		counter = &Counter{labelValues: labelValues}
+		v.children[key] = counter
+	}
+
+	return counter
+}
+
+func (v *CounterVec) write(writer io.Writer) {
+	v.lock.Lock()
+	children := sortedChildren(v.children)
+	v.lock.Unlock()
+
+	v.writeHeader(writer)
+	for _, counter := range children {
+		writeSample(writer, v.name, v.labelNames, counter.labelValues, float64(atomic.LoadUint64(&counter.value)))
+	}
+}
+
+func sortedChildren(children map[string]*Counter) []*Counter {
+	keys := make([]string, 0, len(children))
+	for key := range children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]*Counter, len(keys))
+	for i, key := range keys {
+		sorted[i] = children[key]
+	}
+	return sorted
+}
+
+/*===Func===*/
+
+// Func collects its samples when scraped, by emitting a value for every label values.
+type Func struct {
+	descriptor
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+func NewGaugeFunc(name string, help string, collect func(emit func(value float64, labelValues ...string)), labelNames ...string) *Func {
+	return newFunc(newDescriptor(name, help, "gauge", labelNames), collect)
+}
+
+// NewCounterFunc exposes a counter maintained elsewhere, collect must only emit growing values.
+func NewCounterFunc(name string, help string, collect func(emit func(value float64, labelValues ...string)), labelNames ...string) *Func {
+	return newFunc(newDescriptor(name, help, "counter", labelNames), collect)
+}
+
+func newFunc(descriptor descriptor, collect func(emit func(value float64, labelValues ...string))) *Func {
+	metric := &Func{
+		descriptor: descriptor,
+		collect:    collect,
+	}
+	registry.register(metric.name, metric)
+	return metric
+}
+
+func (f *Func) write(writer io.Writer) {
+	f.writeHeader(writer)
+	f.collect(func(value float64, labelValues ...string) {
+		writeSample(writer, f.name, f.labelNames, labelValues, value)
+	})
+}
+
+/*===Histogram===*/
+
+type Histogram struct {
+	descriptor
+	buckets []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{
+		descriptor: newDescriptor(name, help, "histogram", nil),
+		buckets:    buckets,
+		counts:     make([]uint64, len(buckets)),
+	}
+	registry.register(histogram.name, histogram)
+	return histogram
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *Histogram) write(writer io.Writer) {
+	h.lock.Lock()
+	counts := append([]uint64{}, h.counts...)
+	sum, count := h.sum, h.count
+	h.lock.Unlock()
+
+	h.writeHeader(writer)
+	for i, bound := range h.buckets {
+		writeSample(writer, h.name+"_bucket", []string{"le"}, []string{formatValue(bound)}, float64(counts[i]))
+	}
+	writeSample(writer, h.name+"_bucket", []string{"le"}, []string{"+Inf"}, float64(count))
+	writeSample(writer, h.name+"_sum", nil, nil, sum)
+	writeSample(writer, h.name+"_count", nil, nil, float64(count))
+}
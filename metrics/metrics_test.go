@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	registry.families = map[string]family{}
+
+	counter := NewCounterVec("test_bytes_total", "Bytes.", "tunnel", "direction")
+	counter.With("web", "in").Add(10)
+	counter.With("web\"1", "out").Inc()
+
+	NewGaugeFunc("test_agents", "Agents.", func(emit func(value float64, labelValues ...string)) {
+		emit(2)
+	})
+
+	histogram := NewHistogram("test_seconds", "Latency.", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+
+	buffer := &bytes.Buffer{}
+	WriteText(buffer)
+
+	expected := `# HELP tunnel_transporter_test_agents Agents.
+# TYPE tunnel_transporter_test_agents gauge
+tunnel_transporter_test_agents 2
+# HELP tunnel_transporter_test_bytes_total Bytes.
+# TYPE tunnel_transporter_test_bytes_total counter
+tunnel_transporter_test_bytes_total{tunnel="web\"1",direction="out"} 1
+tunnel_transporter_test_bytes_total{tunnel="web",direction="in"} 10
+# HELP tunnel_transporter_test_seconds Latency.
+# TYPE tunnel_transporter_test_seconds histogram
+tunnel_transporter_test_seconds_bucket{le="0.1"} 1
+tunnel_transporter_test_seconds_bucket{le="1"} 2
+tunnel_transporter_test_seconds_bucket{le="+Inf"} 2
+tunnel_transporter_test_seconds_sum 0.55
+tunnel_transporter_test_seconds_count 2
+`
+	if actual := buffer.String(); actual != expected {
+		t.Fatalf("unexpected output:\n%s\nexpected:\n%s", actual, strings.TrimSpace(expected))
+	}
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		buffer := &bytes.Buffer{}
+		WriteText(buffer)
+
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = writer.Write(buffer.Bytes())
+	})
+}
+
+// Serve exposes the metrics on /metrics of the given port.
+func Serve(port int) {
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/metrics", Handler())
+
+	log.WithField("port", port).Info("exposing metrics")
+	if err := http.ListenAndServe(":"+strconv.Itoa(port), serveMux); err != nil {
+		log.WithField("port", port).WithError(err).Error("error serving metrics")
+	}
+}
@@ -0,0 +1,246 @@
+package mux
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync"
+)
+
+type frameType uint8
+
+const (
+	frameOpen frameType = iota + 1
+	frameData
+	frameWindowUpdate
+	frameClose
+	frameReset
+)
+
+const (
+	headerSize    = 9
+	maxFrameSize  = 32 * 1024
+	initialWindow = 256 * 1024
+	acceptBacklog = 64
+)
+
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrStreamReset   = errors.New("stream reset by peer")
+	ErrTimeout       = timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Session multiplexes logical streams over a single connection. Every frame starts
+// with a 9 bytes header: type (1 byte), stream id (4 bytes) and length (4 bytes).
+// For window update frames the length field carries the window increment instead.
+type Session struct {
+	conn net.Conn
+
+	nextStreamId uint32
+	streams      map[uint32]*Stream
+	streamsLock  sync.Mutex
+
+	writeLock  sync.Mutex
+	acceptChan chan *Stream
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSession starts a session over conn. Stream ids opened by the client side are
+// odd and stream ids opened by the server side are even, so both ends can open
+// streams without coordination.
+func NewSession(conn net.Conn, isClient bool) *Session {
+	session := &Session{
+		conn:       conn,
+		streams:    map[uint32]*Stream{},
+		acceptChan: make(chan *Stream, acceptBacklog),
+		closed:     make(chan struct{}),
+	}
+
+	if isClient {
+		session.nextStreamId = 1
+	} else {
+		session.nextStreamId = 2
+	}
+
+	go session.receive()
+
+	return session
+}
+
+func (s *Session) Open() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+
+	s.streamsLock.Lock()
+	id := s.nextStreamId
+	s.nextStreamId += 2
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.streamsLock.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.acceptChan:
+		return stream, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		_ = s.conn.Close()
+
+		s.streamsLock.Lock()
+		for _, stream := range s.streams {
+			stream.notify()
+		}
+		s.streams = map[uint32]*Stream{}
+		s.streamsLock.Unlock()
+	})
+
+	return nil
+}
+
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) writeFrame(t frameType, id uint32, length uint32, payload []byte) error {
+	buffer := make([]byte, headerSize+len(payload))
+	buffer[0] = byte(t)
+	binary.BigEndian.PutUint32(buffer[1:5], id)
+	binary.BigEndian.PutUint32(buffer[5:9], length)
+	copy(buffer[headerSize:], payload)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+
+	if _, err := s.conn.Write(buffer); err != nil {
+		_ = s.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (s *Session) receive() {
+	defer s.Close()
+
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+
+		t := frameType(header[0])
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+
+		switch t {
+		case frameOpen:
+			s.handleOpen(id)
+		case frameData:
+			if length > maxFrameSize {
+				return
+			}
+
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				return
+			}
+
+			if stream := s.getStream(id); stream != nil {
+				if !stream.receiveData(payload) {
+					s.removeStream(id)
+					_ = s.writeFrame(frameReset, id, 0, nil)
+				}
+			}
+		case frameWindowUpdate:
+			if stream := s.getStream(id); stream != nil {
+				stream.receiveWindowUpdate(length)
+			}
+		case frameClose:
+			if stream := s.getStream(id); stream != nil {
+				stream.receiveClose()
+			}
+		case frameReset:
+			if stream := s.getStream(id); stream != nil {
+				stream.receiveReset()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *Session) handleOpen(id uint32) {
+	s.streamsLock.Lock()
+	if _, exists := s.streams[id]; exists {
+		s.streamsLock.Unlock()
+		_ = s.writeFrame(frameReset, id, 0, nil)
+		return
+	}
+
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.streamsLock.Unlock()
+
+	select {
+	case s.acceptChan <- stream:
+	default:
+		s.removeStream(id)
+		_ = s.writeFrame(frameReset, id, 0, nil)
+	}
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	delete(s.streams, id)
+}
@@ -0,0 +1,132 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newSessionPair(t *testing.T) (*Session, *Session) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewSession(clientConn, true)
+	server := NewSession(<-accepted, false)
+	return client, server
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	client, server := newSessionPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := bytes.Repeat([]byte("tunnel-transporter"), 100000)
+	go func() {
+		_, _ = stream.Write(payload)
+		_ = stream.Close()
+	}()
+
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("received %d bytes, expected %d", len(received), len(payload))
+	}
+}
+
+func TestStreamIds(t *testing.T) {
+	client, server := newSessionPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	first, _ := client.Open()
+	second, _ := client.Open()
+	fromServer, _ := server.Open()
+
+	if first.Id() != 1 || second.Id() != 3 || fromServer.Id() != 2 {
+		t.Fatalf("unexpected stream ids %d, %d, %d", first.Id(), second.Id(), fromServer.Id())
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	client, server := newSessionPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.Open()
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = accepted.Reset()
+
+	buffer := make([]byte, 1)
+	if _, err = stream.Read(buffer); err != ErrStreamReset {
+		t.Fatalf("expected reset error, got %v", err)
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, server := newSessionPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.Open()
+	_ = stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	buffer := make([]byte, 1)
+	if _, err := stream.Read(buffer); err != ErrTimeout {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := newSessionPair(t)
+	defer server.Close()
+
+	stream, _ := client.Open()
+	_ = client.Close()
+
+	if _, err := stream.Write([]byte("data")); err == nil {
+		t.Fatal("expected error writing to closed session")
+	}
+
+	if _, err := server.Accept(); err != nil {
+		return
+	}
+
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		t.Fatal("server session not closed after client closed")
+	}
+}
@@ -0,0 +1,297 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a logical, flow controlled connection inside a Session. It implements
+// net.Conn so it can be used anywhere a tcp connection is expected.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	lock     sync.Mutex
+	buffer   bytes.Buffer
+	consumed uint32
+
+	sendWindow uint32
+
+	localClosed  bool
+	remoteClosed bool
+	reset        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+}
+
+func newStream(id uint32, session *Session) *Stream {
+	return &Stream{
+		id:          id,
+		session:     session,
+		sendWindow:  initialWindow,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+func (s *Stream) Id() uint32 {
+	return s.id
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	for {
+		s.lock.Lock()
+		if s.buffer.Len() > 0 {
+			n, _ := s.buffer.Read(p)
+			s.consumed += uint32(n)
+
+			var increment uint32
+			if s.consumed >= initialWindow/2 {
+				increment = s.consumed
+				s.consumed = 0
+			}
+			s.lock.Unlock()
+
+			if increment > 0 {
+				_ = s.session.writeFrame(frameWindowUpdate, s.id, increment, nil)
+			}
+			return n, nil
+		}
+
+		if s.reset {
+			s.lock.Unlock()
+			return 0, ErrStreamReset
+		}
+
+		if s.remoteClosed {
+			s.lock.Unlock()
+			return 0, io.EOF
+		}
+
+		if s.localClosed {
+			s.lock.Unlock()
+			return 0, ErrStreamClosed
+		}
+
+		deadline := s.readDeadline
+		s.lock.Unlock()
+
+		if err := s.wait(s.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.lock.Lock()
+		if s.reset {
+			s.lock.Unlock()
+			return written, ErrStreamReset
+		}
+
+		if s.localClosed {
+			s.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.lock.Unlock()
+
+			if err := s.wait(s.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		size := uint32(len(p) - written)
+		if size > s.sendWindow {
+			size = s.sendWindow
+		}
+		if size > maxFrameSize {
+			size = maxFrameSize
+		}
+		s.sendWindow -= size
+		s.lock.Unlock()
+
+		if err := s.session.writeFrame(frameData, s.id, size, p[written:written+int(size)]); err != nil {
+			return written, err
+		}
+		written += int(size)
+	}
+
+	return written, nil
+}
+
+// Close closes both directions of the stream and tells the peer no more data will be sent.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.localClosed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	remoteDone := s.remoteClosed || s.reset
+	reset := s.reset
+	s.lock.Unlock()
+
+	s.notify()
+
+	if remoteDone {
+		s.session.removeStream(s.id)
+	}
+
+	if reset {
+		return nil
+	}
+
+	return s.session.writeFrame(frameClose, s.id, 0, nil)
+}
+
+// Reset aborts the stream, discarding any buffered data on both ends.
+func (s *Stream) Reset() error {
+	s.lock.Lock()
+	if s.reset {
+		s.lock.Unlock()
+		return nil
+	}
+	s.reset = true
+	s.localClosed = true
+	s.lock.Unlock()
+
+	s.notify()
+	s.session.removeStream(s.id)
+
+	return s.session.writeFrame(frameReset, s.id, 0, nil)
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	s.lock.Unlock()
+
+	s.notify()
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	s.lock.Unlock()
+
+	s.notify()
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline = t
+	s.lock.Unlock()
+
+	s.notify()
+	return nil
+}
+
+func (s *Stream) receiveData(payload []byte) bool {
+	s.lock.Lock()
+	if s.localClosed {
+		s.lock.Unlock()
+		return true
+	}
+
+	if uint32(s.buffer.Len())+s.consumed+uint32(len(payload)) > initialWindow {
+		s.reset = true
+		s.lock.Unlock()
+		s.notify()
+		return false
+	}
+
+	s.buffer.Write(payload)
+	s.lock.Unlock()
+
+	s.notify()
+	return true
+}
+
+func (s *Stream) receiveWindowUpdate(increment uint32) {
+	s.lock.Lock()
+	s.sendWindow += increment
+	s.lock.Unlock()
+
+	s.notify()
+}
+
+func (s *Stream) receiveClose() {
+	s.lock.Lock()
+	s.remoteClosed = true
+	localDone := s.localClosed
+	s.lock.Unlock()
+
+	s.notify()
+
+	if localDone {
+		s.session.removeStream(s.id)
+	}
+}
+
+func (s *Stream) receiveReset() {
+	s.lock.Lock()
+	s.reset = true
+	s.lock.Unlock()
+
+	s.notify()
+	s.session.removeStream(s.id)
+}
+
+func (s *Stream) notify() {
+	select {
+	case s.readNotify <- struct{}{}:
+	default:
+	}
+
+	select {
+	case s.writeNotify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) wait(notify <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrTimeout
+		}
+
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-notify:
+		return nil
+	case <-s.session.closed:
+		return ErrSessionClosed
+	case <-timeout:
+		return ErrTimeout
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"time"
+	"tunnel-transporter/accesslog"
+)
+
+var (
+	// ErrAccessDenied is the cause of a public connection denied by access control or the auth webhook.
+	ErrAccessDenied = errors.New("public connection denied")
+	// ErrConnectionRefused is the cause of a public connection refused by the limits or the quota
+	// of the tunnel, or because the auth webhook could not review it.
+	ErrConnectionRefused = errors.New("public connection refused")
+
+	errDataConnectionTimeout = errors.New("timeout waiting for data connection")
+	errTunnelDraining        = errors.New("tunnel is draining")
+)
+
+// logAccess completes the record with the tunnel and writes it to the access log, when one
+// is configured.
+func (t *Tunnel) logAccess(record accesslog.Record, err error) {
+	if accesslog.Log == nil {
+		return
+	}
+
+	record.Duration = time.Since(record.Start)
+	record.AgentId = t.AgentId
+	record.Tunnel = t.Name
+	record.TunnelType = string(t.Type)
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	accesslog.Log.Write(record)
+}
+
+func (t *Tunnel) deny(publicConnection net.Conn, start time.Time, err error) {
+	t.logAccess(accesslog.Record{Start: start, RemoteAddr: publicConnection.RemoteAddr().String(), Reason: accesslog.Denied}, err)
+}
+
+// fail records a public connection for which no connection to the local service could be opened.
+func (t *Tunnel) fail(publicConnection net.Conn, start time.Time, err error) {
+	reason := accesslog.AgentFailed
+	if isTimeout(err) {
+		reason = accesslog.Timeout
+	} else if err == errTunnelDraining {
+		reason = accesslog.Denied
+	}
+
+	t.logAccess(accesslog.Record{Start: start, RemoteAddr: publicConnection.RemoteAddr().String(), Reason: reason}, err)
+}
+
+// closeReason tells why a join ended from the connection whose stream ended first.
+func closeReason(connection *PublicConnection, publicConnection net.Conn, closedBy net.Conn, err error) string {
+	switch {
+	case connection.closeKind() == adminClose:
+		return accesslog.AdminClosed
+	case connection.closeKind() == shutdownClose:
+		return accesslog.Shutdown
+	case isTimeout(err):
+		return accesslog.Timeout
+	case closedBy == publicConnection:
+		return accesslog.ClientClosed
+	case err != nil:
+		return accesslog.AgentFailed
+	default:
+		return accesslog.AgentClosed
+	}
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Cause(err) == errDataConnectionTimeout {
+		return true
+	}
+
+	netErr, ok := errors.Cause(err).(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -2,142 +2,447 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"tunnel-transporter/auth"
 	"tunnel-transporter/config"
+	"tunnel-transporter/config/agent"
+	"tunnel-transporter/constants"
 	"tunnel-transporter/message"
+	"tunnel-transporter/mux"
 	"tunnel-transporter/util"
 )
 
+const (
+	heartbeatInterval = 10 * time.Second
+	heartbeatTimeout  = 30 * time.Second
+)
+
+// HandshakeTimeout bounds the handshake of an agent connection, from the auth challenge until
+// the control connection is established.
+var HandshakeTimeout = 30 * time.Second
+
+// ErrUnauthorized is the cause of a bootstrap the server rejected for the identity of the agent.
+var ErrUnauthorized = errors.New("agent unauthorized by server")
+
+// BootstrapConnection is the control connection between agent and server. Both sides ping
+// each other every heartbeatInterval, measuring the round trip time from the echoed pong, and
+// give the connection up when nothing was received for heartbeatTimeout.
 type BootstrapConnection struct {
-	raw *RawConnection
+	raw        *RawConnection
+	sessionKey string
+	tunnels    []message.TunnelResponse
+
+	lastReceived  int64
+	roundTripTime int64
 
-	pingTicker        *time.Ticker
-	pingTimeoutTicker *time.Ticker
-	pongTimeoutTicker *time.Ticker
+	activeLock        sync.Mutex
+	activeConnections map[string]int
+
+	draining     int32
+	goAwayOnce   sync.Once
+	goAway       chan struct{}
+	goAwayReason string
 }
 
-func NewBootstrapConnection(ctx context.Context, cancel chan<- error, conn *net.TCPConn, isServer bool) *BootstrapConnection {
+func NewBootstrapConnection(ctx context.Context, cancel chan<- error, conn net.Conn, isServer bool) *BootstrapConnection {
 	bootstrap := BootstrapConnection{
-		raw:               NewRawConnection(ctx, cancel, conn),
-		pingTicker:        time.NewTicker(10 * time.Second),
-		pingTimeoutTicker: time.NewTicker(30 * time.Second),
-		pongTimeoutTicker: time.NewTicker(30 * time.Second),
+		lastReceived:      time.Now().UnixNano(),
+		activeConnections: map[string]int{},
+		goAway:            make(chan struct{}),
 	}
 
 	if isServer {
-		bootstrap.pingTicker.Stop()
-		bootstrap.pongTimeoutTicker.Stop()
+		bootstrap.raw = NewRawConnection(ctx, cancel, conn)
 	} else {
-		bootstrap.pingTimeoutTicker.Stop()
-		bootstrap.raw.write(message.BootstrapRequestMessage{
-			AgentId:     config.ClientConfig.Agent.Id,
-			StaticToken: config.ClientConfig.Agent.Authentication.StaticToken.Token,
-		})
+		controlConnection, err := bootstrap.handshake(ctx, conn)
+		if err != nil {
+			log.WithError(err).Error("error bootstrapping agent")
+			_ = conn.Close()
+			cancel <- err
+			return nil
+		}
+		bootstrap.raw = NewRawConnection(ctx, cancel, controlConnection)
 	}
 
 	go bootstrap.shutdown(ctx)
 	go bootstrap.handleCommand(ctx, cancel)
+	go bootstrap.heartbeat(ctx, cancel)
 
 	return &bootstrap
 }
 
-func (b *BootstrapConnection) handleCommand(ctx context.Context, cancel chan<- error) {
+// RoundTripTime returns the heartbeat round trip time last measured, zero before the first pong.
+func (b *BootstrapConnection) RoundTripTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.roundTripTime))
+}
+
+// Tunnels returns the public endpoints the server assigned to the tunnels of the agent.
+func (b *BootstrapConnection) Tunnels() []message.TunnelResponse {
+	return b.tunnels
+}
+
+// ActiveConnections returns the number of connections joined with the local service, by tunnel name.
+func (b *BootstrapConnection) ActiveConnections() map[string]int {
+	b.activeLock.Lock()
+	defer b.activeLock.Unlock()
+
+	activeConnections := make(map[string]int, len(b.activeConnections))
+	for tunnelName, active := range b.activeConnections {
+		activeConnections[tunnelName] = active
+	}
+
+	return activeConnections
+}
+
+// GoAway announces this side is shutting down. The connections already joined keep running,
+// while an agent going away refuses every new connection the server asks for.
+func (b *BootstrapConnection) GoAway(reason string) {
+	atomic.StoreInt32(&b.draining, 1)
+	b.raw.write(message.GoAwayMessage{Reason: reason})
+}
+
+// GoingAway is closed once the other side announced it is shutting down.
+func (b *BootstrapConnection) GoingAway() <-chan struct{} {
+	return b.goAway
+}
+
+// GoAwayReason returns the reason the other side announced, blank until it is going away.
+func (b *BootstrapConnection) GoAwayReason() string {
+	select {
+	case <-b.goAway:
+		return b.goAwayReason
+	default:
+		return ""
+	}
+}
+
+// handshake sends the bootstrap request and waits for the server's answer. When the server
+// accepts multiplexing, the connection is switched to a mux session and the first stream
+// opened by the agent becomes the control connection.
+func (b *BootstrapConnection) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	nonce, err := readChallenge(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	requestMessage := message.BootstrapRequestMessage{
+		AgentVersion: constants.Version,
+		AgentId:      config.Get().Agent.Id,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Timestamp:    time.Now().Unix(),
+		Multiplex:    config.Get().Agent.Multiplex,
+	}
+
+	var token string
+	switch config.Get().Agent.Authentication.Type {
+	case constants.StaticToken:
+		token = config.Get().Agent.Authentication.StaticToken.Token
+		requestMessage.Proof = auth.Sign(token, nonce, requestMessage.AgentId, requestMessage.Timestamp)
+	case constants.SignedToken:
+		token = config.Get().Agent.Authentication.SignedToken.Token
+		presented, whole := auth.PresentToken(token)
+		if _, isTls := conn.(*tls.Conn); whole && !isTls {
+			return nil, errors.New("ed25519 signed token requires the tls transport")
+		}
+
+		_, signature := auth.SplitToken(token)
+		requestMessage.Token = presented
+		requestMessage.Proof = auth.Sign(signature, nonce, requestMessage.AgentId, requestMessage.Timestamp)
+	}
+
+	for _, tunnel := range config.Get().Agent.Tunnels {
+		requestMessage.Tunnels = append(requestMessage.Tunnels, message.TunnelRequest{
+			Name:       tunnel.Name,
+			Type:       tunnel.Type,
+			RemotePort: tunnel.RemotePort,
+
+			CustomDomains: tunnel.CustomDomains,
+			Subdomain:     tunnel.Subdomain,
+
+			Limits: tunnel.Limits,
+		})
+	}
+
+	if err := util.Write(conn, requestMessage); err != nil {
+		return nil, err
+	}
+
+	receivedMessage, err := util.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	responseMessage, ok := receivedMessage.(*message.BootstrapResponseMessage)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected message %s during bootstrap", receivedMessage.GetType()))
+	}
+
+	if responseMessage.Unauthorized {
+		return nil, errors.Wrap(ErrUnauthorized, responseMessage.Error)
+	}
+
+	if responseMessage.Error != "" {
+		return nil, errors.New(fmt.Sprintf("error creating bootstrap connection, reason: %v", responseMessage.Error))
+	}
+
+	if responseMessage.SessionNonce != "" {
+		b.sessionKey = auth.SessionKey(token, nonce, responseMessage.SessionNonce)
+	}
+
+	b.tunnels = responseMessage.Tunnels
+	for _, tunnel := range responseMessage.Tunnels {
+		if len(tunnel.Hosts) > 0 {
+			agentLogger(tunnel.Name).WithField(constants.HostsField, strings.Join(tunnel.Hosts, ",")).Info("tunnel exposed on hosts")
+		} else {
+			agentLogger(tunnel.Name).WithField(constants.PublicPortField, tunnel.PublicPort).Info("tunnel exposed on public port")
+		}
+	}
+
+	if !responseMessage.Multiplex {
+		return conn, nil
+	}
+
+	session := mux.NewSession(conn, true)
+	controlStream, err := session.Open()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+
+	go b.acceptStreams(ctx, session)
+
+	return controlStream, nil
+}
+
+func (b *BootstrapConnection) heartbeat(ctx context.Context, cancel chan<- error) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	b.raw.write(message.PingMessage{Timestamp: time.Now().UnixNano()})
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-b.pingTicker.C:
-			b.raw.write(message.PingMessage{})
-			b.pongTimeoutTicker.Reset(10 * time.Second)
-		case <-b.pingTimeoutTicker.C:
-			err := errors.New("heartbeat failure, ping did not receive in time")
-			log.Error(err)
-			cancel <- err
-			return
-		case <-b.pongTimeoutTicker.C:
-			err := errors.New("heartbeat failure, pong did not receive in time")
-			log.Error(err)
-			cancel <- err
-			return
-		default:
-			receivedMessage := b.raw.read()
-			if receivedMessage == nil {
-				continue
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&b.lastReceived))) > heartbeatTimeout {
+				err := errors.New("heartbeat failure, nothing received in time")
+				log.Error(err)
+
+				func() {
+					defer func() {
+						_ = recover()
+					}()
+					cancel <- err
+				}()
+				return
 			}
 
-			log.Debugf("receive command %s", receivedMessage.GetType())
-
-			go func() {
-				switch receivedMessage.GetType() {
-				case message.Ping:
-					b.handlePing(*receivedMessage.(*message.PingMessage))
-				case message.Pong:
-					b.handlePong(*receivedMessage.(*message.PongMessage))
-				case message.RequireConnectionRequest:
-					b.handleRequireConnectionRequest(ctx, cancel, *receivedMessage.(*message.RequireNewConnectionRequestMessage))
-				case message.BootstrapResponse:
-					b.handleBootstrapResponse(ctx, cancel, *receivedMessage.(*message.BootstrapResponseMessage))
-				case message.BootstrapRequest, message.RequireConnectionResponse:
-					//no need to implement
-				default:
-					log.Warn("received unknown message type")
-				}
-			}()
+			b.raw.write(message.PingMessage{Timestamp: time.Now().UnixNano()})
 		}
 	}
 }
 
+func (b *BootstrapConnection) handleCommand(ctx context.Context, cancel chan<- error) {
+	for {
+		receivedMessage := b.raw.read()
+		if receivedMessage == nil {
+			return
+		}
+		atomic.StoreInt64(&b.lastReceived, time.Now().UnixNano())
+
+		log.WithField("command", receivedMessage.GetType()).Debug("receive command")
+
+		go func() {
+			switch receivedMessage.GetType() {
+			case message.Ping:
+				b.handlePing(*receivedMessage.(*message.PingMessage))
+			case message.Pong:
+				b.handlePong(*receivedMessage.(*message.PongMessage))
+			case message.RequireConnectionRequest:
+				b.handleRequireConnectionRequest(ctx, cancel, *receivedMessage.(*message.RequireNewConnectionRequestMessage))
+			case message.GoAway:
+				b.handleGoAway(*receivedMessage.(*message.GoAwayMessage))
+			case message.AuthChallenge, message.BootstrapRequest, message.BootstrapResponse, message.RequireConnectionResponse:
+				//no need to implement
+			default:
+				log.Warn("received unknown message type")
+			}
+		}()
+	}
+}
+
 func (b *BootstrapConnection) handlePing(pingMessage message.PingMessage) {
-	b.raw.write(message.PongMessage{})
-	b.pingTimeoutTicker.Stop()
+	b.raw.write(message.PongMessage{Timestamp: pingMessage.Timestamp})
+}
+
+func (b *BootstrapConnection) handleGoAway(goAwayMessage message.GoAwayMessage) {
+	b.goAwayOnce.Do(func() {
+		b.goAwayReason = goAwayMessage.Reason
+		close(b.goAway)
+	})
 }
 
 func (b *BootstrapConnection) handlePong(pongMessage message.PongMessage) {
-	b.pongTimeoutTicker.Stop()
+	roundTripTime := time.Since(time.Unix(0, pongMessage.Timestamp))
+	atomic.StoreInt64(&b.roundTripTime, int64(roundTripTime))
+	log.WithField("rtt", roundTripTime.String()).Debug("heartbeat round trip time measured")
 }
 
 func (b *BootstrapConnection) handleRequireConnectionRequest(ctx context.Context, cancel chan<- error, requestMessage message.RequireNewConnectionRequestMessage) {
-	localIp, localPort := util.ResolveAddress(config.ClientConfig.Agent.LocalEndpoint)
-	localConnection, err := util.Dial(localIp, localPort)
+	serverIp, serverPort := util.ResolveAddress(config.Get().Agent.ServerEndpoint)
+	proxyConnection, err := util.DialWithTls(serverIp, serverPort, agent.TlsConfig)
 	if err != nil {
-		log.Errorf("error dialing local service, reason: %v", err)
+		agentLogger(requestMessage.TunnelName).WithField(constants.ConnIdField, requestMessage.ConnectionId).WithError(err).Error("error creating proxy connection")
 		return
 	}
 
-	serverIp, serverPort := util.ResolveAddress(config.ClientConfig.Agent.ServerEndpoint)
-	proxyConnection, err := util.Dial(serverIp, serverPort)
+	nonce, err := readChallenge(proxyConnection)
 	if err != nil {
-		log.Errorf("error crearing proxy connection, reason: %v", err)
+		agentLogger(requestMessage.TunnelName).WithField(constants.ConnIdField, requestMessage.ConnectionId).WithError(err).Error("error reading auth challenge of proxy connection")
+		proxyConnection.Close()
 		return
 	}
 
-	wrappedProxyConnection := NewDataConnection(ctx, cancel, proxyConnection)
-	err = util.Write(proxyConnection, message.RequireNewConnectionResponseMessage{
-		AgentId:     config.ClientConfig.Agent.Id,
-		StaticToken: config.ClientConfig.Agent.Authentication.StaticToken.Token})
+	responseMessage := message.RequireNewConnectionResponseMessage{
+		AgentId:      config.Get().Agent.Id,
+		ConnectionId: requestMessage.ConnectionId,
+		Timestamp:    time.Now().Unix(),
+	}
+	if b.sessionKey != "" {
+		responseMessage.Proof = auth.Sign(b.sessionKey, nonce, responseMessage.AgentId, responseMessage.Timestamp)
+	}
+
+	localConnection, err := b.dialLocal(requestMessage.TunnelName)
 	if err != nil {
-		log.Errorf("error writing connection, reason: %v", err)
+		agentLogger(requestMessage.TunnelName).WithField(constants.ConnIdField, requestMessage.ConnectionId).WithError(err).Error("error dialing local service")
+		responseMessage.Error = err.Error()
+		_ = util.Write(proxyConnection, responseMessage)
+		proxyConnection.Close()
 		return
 	}
 
-	wrappedProxyConnection.join(localConnection)
+	wrappedProxyConnection := NewDataConnection(ctx, cancel, proxyConnection)
+	if err = util.Write(proxyConnection, responseMessage); err != nil {
+		agentLogger(requestMessage.TunnelName).WithField(constants.ConnIdField, requestMessage.ConnectionId).WithError(err).Error("error writing connection")
+		localConnection.Close()
+		return
+	}
+
+	b.joinLocal(wrappedProxyConnection.raw.Conn, localConnection, requestMessage.TunnelName)
 }
 
-func (b *BootstrapConnection) handleBootstrapResponse(ctx context.Context, cancel chan<- error, responseMessage message.BootstrapResponseMessage) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Warnf("error handling bootstrapResponse message, reason: %v", err)
+func (b *BootstrapConnection) acceptStreams(ctx context.Context, session *mux.Session) {
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = session.Close()
+		case <-session.Done():
 		}
 	}()
 
-	if responseMessage.Error != "" {
-		cancel <- errors.New(fmt.Sprintf("error creating bootstrap connection, reason, %v", responseMessage.Error))
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+
+		go b.handleStream(stream)
+	}
+}
+
+func (b *BootstrapConnection) handleStream(stream *mux.Stream) {
+	receivedMessage, err := util.Read(stream)
+	if err != nil {
+		log.WithField(constants.ConnIdField, stream.Id()).WithError(err).Error("error reading stream header")
+		_ = stream.Reset()
+		return
+	}
+
+	openMessage, ok := receivedMessage.(*message.StreamOpenMessage)
+	if !ok {
+		log.WithFields(log.Fields{constants.ConnIdField: stream.Id(), "command": receivedMessage.GetType()}).Error("unexpected message as stream header")
+		_ = stream.Reset()
+		return
+	}
+
+	localConnection, err := b.dialLocal(openMessage.TunnelName)
+	if err != nil {
+		agentLogger(openMessage.TunnelName).WithField(constants.ConnIdField, stream.Id()).WithError(err).Error("error dialing local service")
+		_ = stream.Reset()
 		return
 	}
+
+	agentLogger(openMessage.TunnelName).WithField(constants.ConnIdField, stream.Id()).Debug("stream connected to local service")
+	b.joinLocal(stream, localConnection, openMessage.TunnelName)
+}
+
+// joinLocal joins the connection from the server with the local service of the tunnel,
+// counting the bytes passing each way.
+func (b *BootstrapConnection) joinLocal(serverConnection net.Conn, localConnection net.Conn, tunnelName string) {
+	b.activeLock.Lock()
+	b.activeConnections[tunnelName]++
+	b.activeLock.Unlock()
+
+	defer func() {
+		b.activeLock.Lock()
+		b.activeConnections[tunnelName]--
+		b.activeLock.Unlock()
+	}()
+
+	agentId := config.Get().Agent.Id
+	util.JoinCounted(serverConnection, localConnection, countBytes(agentId, tunnelName, directionOut), countBytes(agentId, tunnelName, directionIn))
+}
+
+// readChallenge reads the nonce the server challenges every new connection with.
+func readChallenge(conn net.Conn) (string, error) {
+	receivedMessage, err := util.Read(conn)
+	if err != nil {
+		return "", err
+	}
+
+	challengeMessage, ok := receivedMessage.(*message.AuthChallengeMessage)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("unexpected message %s instead of auth challenge", receivedMessage.GetType()))
+	}
+
+	return challengeMessage.Nonce, nil
+}
+
+// dialLocal connects to the local service of the tunnel unless the agent is going away.
+func (b *BootstrapConnection) dialLocal(tunnelName string) (net.Conn, error) {
+	if atomic.LoadInt32(&b.draining) == 1 {
+		return nil, errors.New("agent is going away")
+	}
+
+	return dialLocalEndpoint(tunnelName)
+}
+
+func dialLocalEndpoint(tunnelName string) (net.Conn, error) {
+	tunnel, ok := config.Get().Agent.GetTunnel(tunnelName)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown tunnel %s", tunnelName))
+	}
+
+	localIp, localPort := util.ResolveAddress(tunnel.LocalEndpoint)
+	if tunnel.Type == constants.UDP {
+		conn, err := util.DialUdp(localIp, localPort)
+		if err != nil {
+			return nil, err
+		}
+		return util.NewDatagramConnection(conn), nil
+	}
+
+	return util.Dial(localIp, localPort)
 }
 
 func (b *BootstrapConnection) shutdown(ctx context.Context) {
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+	"tunnel-transporter/message"
+)
+
+var (
+	errTooManyConnections      = errors.New("too many connections")
+	errTooManyConnectionsPerIp = errors.New("too many connections from ip")
+	errRateLimited             = errors.New("connection rate exceeded")
+)
+
+// connectionLimiter counts the public connections of a tunnel, in total and per remote ip,
+// and rate limits new connections with a token bucket.
+type connectionLimiter struct {
+	limits message.TunnelLimits
+
+	lock       sync.Mutex
+	active     int
+	perIp      map[string]int
+	tokens     float64
+	lastRefill time.Time
+	refused    uint64
+}
+
+// effectiveLimits applies the tighter one of every server and requested limit.
+func effectiveLimits(serverLimits message.TunnelLimits, requestedLimits message.TunnelLimits) message.TunnelLimits {
+	tighterInt := func(a int, b int) int {
+		if a <= 0 || (b > 0 && b < a) {
+			return b
+		}
+		return a
+	}
+
+	limits := message.TunnelLimits{
+		MaxConnections:      tighterInt(serverLimits.MaxConnections, requestedLimits.MaxConnections),
+		MaxConnectionsPerIp: tighterInt(serverLimits.MaxConnectionsPerIp, requestedLimits.MaxConnectionsPerIp),
+		Rate:                serverLimits.Rate,
+		Burst:               tighterInt(serverLimits.Burst, requestedLimits.Burst),
+	}
+
+	if limits.Rate <= 0 || (requestedLimits.Rate > 0 && requestedLimits.Rate < limits.Rate) {
+		limits.Rate = requestedLimits.Rate
+	}
+
+	if limits.Rate > 0 && limits.Burst <= 0 {
+		limits.Burst = int(math.Max(1, math.Ceil(limits.Rate)))
+	}
+
+	return limits
+}
+
+func newConnectionLimiter(limits message.TunnelLimits) *connectionLimiter {
+	return &connectionLimiter{
+		limits:     limits,
+		perIp:      map[string]int{},
+		tokens:     float64(limits.Burst),
+		lastRefill: time.Now(),
+	}
+}
+
+// acquire admits a new connection from ip, which must be released once it is closed.
+func (l *connectionLimiter) acquire(ip net.IP) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	key := ip.String()
+	err := l.check(key)
+	if err != nil {
+		l.refused++
+		return err
+	}
+
+	l.active++
+	l.perIp[key]++
+	return nil
+}
+
+func (l *connectionLimiter) check(key string) error {
+	if l.limits.MaxConnections > 0 && l.active >= l.limits.MaxConnections {
+		return errTooManyConnections
+	}
+
+	if l.limits.MaxConnectionsPerIp > 0 && l.perIp[key] >= l.limits.MaxConnectionsPerIp {
+		return errTooManyConnectionsPerIp
+	}
+
+	if l.limits.Rate > 0 {
+		now := time.Now()
+		l.tokens = math.Min(float64(l.limits.Burst), l.tokens+now.Sub(l.lastRefill).Seconds()*l.limits.Rate)
+		l.lastRefill = now
+
+		if l.tokens < 1 {
+			return errRateLimited
+		}
+		l.tokens--
+	}
+
+	return nil
+}
+
+func (l *connectionLimiter) release(ip net.IP) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	key := ip.String()
+	l.active--
+	if l.perIp[key]--; l.perIp[key] <= 0 {
+		delete(l.perIp, key)
+	}
+}
+
+func (l *connectionLimiter) stats() (int, uint64) {
+	if l == nil {
+		return 0, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.active, l.refused
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"tunnel-transporter/message"
+)
+
+func TestEffectiveLimits(t *testing.T) {
+	limits := effectiveLimits(
+		message.TunnelLimits{MaxConnections: 100, Rate: 10},
+		message.TunnelLimits{MaxConnections: 200, MaxConnectionsPerIp: 5, Rate: 2.5},
+	)
+
+	expected := message.TunnelLimits{MaxConnections: 100, MaxConnectionsPerIp: 5, Rate: 2.5, Burst: 3}
+	if limits != expected {
+		t.Fatalf("expected %+v, got %+v", expected, limits)
+	}
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	limiter := newConnectionLimiter(message.TunnelLimits{MaxConnections: 3, MaxConnectionsPerIp: 2})
+	first, second := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	if limiter.acquire(first) != nil || limiter.acquire(first) != nil {
+		t.Fatal("expected 2 connections from same ip to be admitted")
+	}
+
+	if err := limiter.acquire(first); err != errTooManyConnectionsPerIp {
+		t.Fatalf("expected per ip limit, got %v", err)
+	}
+
+	if err := limiter.acquire(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := limiter.acquire(second); err != errTooManyConnections {
+		t.Fatalf("expected total limit, got %v", err)
+	}
+
+	limiter.release(first)
+	if err := limiter.acquire(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if active, refused := limiter.stats(); active != 3 || refused != 2 {
+		t.Fatalf("expected 3 active and 2 refused, got %d and %d", active, refused)
+	}
+}
+
+func TestConnectionLimiterRate(t *testing.T) {
+	limiter := newConnectionLimiter(effectiveLimits(message.TunnelLimits{Rate: 0.001, Burst: 2}, message.TunnelLimits{}))
+	ip := net.ParseIP("10.0.0.1")
+
+	if limiter.acquire(ip) != nil || limiter.acquire(ip) != nil {
+		t.Fatal("expected burst of 2 connections to be admitted")
+	}
+
+	if err := limiter.acquire(ip); err != errRateLimited {
+		t.Fatalf("expected rate limit, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	log "github.com/sirupsen/logrus"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+)
+
+// logger returns an entry carrying the agent id of the proxy.
+func (t *Proxy) logger() *log.Entry {
+	return log.WithField(constants.AgentIdField, t.AgentId)
+}
+
+// logger returns an entry carrying the agent id, name and public port of the tunnel.
+func (t *Tunnel) logger() *log.Entry {
+	fields := log.Fields{
+		constants.AgentIdField: t.AgentId,
+		constants.TunnelField:  t.Name,
+	}
+	if t.PublicListenPort != 0 {
+		fields[constants.PublicPortField] = t.PublicListenPort
+	}
+
+	return log.WithFields(fields)
+}
+
+// agentLogger returns an entry carrying the agent id and the tunnel name on the agent side.
+func agentLogger(tunnelName string) *log.Entry {
+	return log.WithFields(log.Fields{
+		constants.AgentIdField: config.Get().Agent.Id,
+		constants.TunnelField:  tunnelName,
+	})
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"tunnel-transporter/metrics"
+)
+
+const (
+	directionIn  = "in"
+	directionOut = "out"
+
+	connectionAccepted = "accepted"
+	connectionDenied   = "denied"
+	connectionRefused  = "refused"
+	connectionRejected = "rejected"
+	connectionFailed   = "failed"
+)
+
+var (
+	tunnelBytes = metrics.NewCounterVec("tunnel_bytes_total",
+		"Bytes passed through tunnels, in towards the local service and out from it.", "agent", "tunnel", "direction")
+
+	publicConnections = metrics.NewCounterVec("public_connections_total",
+		"Public connections by result, one of accepted, denied, refused, rejected or failed.", "agent", "tunnel", "result")
+
+	dataConnectionSetup = metrics.NewHistogram("data_connection_setup_seconds",
+		"Time taken to open a connection to the local service of a tunnel.", metrics.DefaultBuckets)
+)
+
+// countBytes returns a counter of the bytes passing the tunnel in the given direction.
+func countBytes(agentId string, tunnelName string, direction string) func(n int) {
+	counter := tunnelBytes.With(agentId, tunnelName, direction)
+	return func(n int) {
+		counter.Add(uint64(n))
+	}
+}
+
+func countConnection(agentId string, tunnelName string, result string) {
+	publicConnections.With(agentId, tunnelName, result).Inc()
+}
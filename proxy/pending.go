@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+var (
+	errUnmatchedConnection = errors.New("no pending request matches connection id")
+	errExpiredConnection   = errors.New("pending request already expired")
+	errDuplicateConnection = errors.New("pending request already fulfilled")
+)
+
+type pendingResult struct {
+	connection *DataConnection
+	err        error
+}
+
+type pendingRequest struct {
+	resultChan chan pendingResult
+	expireAt   time.Time
+	done       bool
+	expired    bool
+}
+
+// pendingRequests correlates data connections dialed by the agent with the public
+// connections waiting for them. Finished and expired requests are kept for another
+// timeout period so late or repeated connection ids can be told apart from unknown ones.
+type pendingRequests struct {
+	lock     sync.Mutex
+	requests map[string]*pendingRequest
+	timeout  time.Duration
+}
+
+func newPendingRequests(timeout time.Duration) *pendingRequests {
+	return &pendingRequests{
+		requests: map[string]*pendingRequest{},
+		timeout:  timeout,
+	}
+}
+
+func (p *pendingRequests) add(connectionId string) (<-chan pendingResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	for id, request := range p.requests {
+		if now.After(request.expireAt.Add(p.timeout)) {
+			delete(p.requests, id)
+		}
+	}
+
+	if _, exists := p.requests[connectionId]; exists {
+		return nil, errors.New(fmt.Sprintf("connection id %s already pending", connectionId))
+	}
+
+	request := &pendingRequest{
+		resultChan: make(chan pendingResult, 1),
+		expireAt:   now.Add(p.timeout),
+	}
+	p.requests[connectionId] = request
+
+	return request.resultChan, nil
+}
+
+func (p *pendingRequests) fulfill(connectionId string, connection *DataConnection) error {
+	return p.complete(connectionId, pendingResult{connection: connection})
+}
+
+func (p *pendingRequests) fail(connectionId string, err error) error {
+	return p.complete(connectionId, pendingResult{err: err})
+}
+
+// complete hands the result to the public connection waiting for it. The data connection of a
+// rejected result is closed, as nobody would ever receive it.
+func (p *pendingRequests) complete(connectionId string, result pendingResult) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := p.accept(connectionId)
+	if err != nil {
+		result.close()
+		return err
+	}
+
+	p.requests[connectionId].done = true
+	p.requests[connectionId].resultChan <- result
+	return nil
+}
+
+func (p *pendingRequests) accept(connectionId string) error {
+	request, ok := p.requests[connectionId]
+	if !ok {
+		return errUnmatchedConnection
+	}
+
+	if request.done {
+		return errDuplicateConnection
+	}
+
+	if request.expired || time.Now().After(request.expireAt) {
+		return errExpiredConnection
+	}
+
+	return nil
+}
+
+// expire ends the request once nobody waits for its result anymore. A data connection
+// fulfilled just before is no longer received by anyone, so it is closed.
+func (p *pendingRequests) expire(connectionId string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	request, ok := p.requests[connectionId]
+	if !ok {
+		return
+	}
+	request.expired = true
+	request.expireAt = time.Now()
+
+	select {
+	case result := <-request.resultChan:
+		result.close()
+	default:
+	}
+}
+
+func (r pendingResult) close() {
+	if r.connection != nil && r.connection.raw != nil {
+		_ = r.connection.raw.Close()
+	}
+}
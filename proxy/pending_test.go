@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPendingRequests(t *testing.T) {
+	pending := newPendingRequests(time.Second)
+
+	resultChan, err := pending.add("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = pending.add("A"); err == nil {
+		t.Fatal("expected error adding duplicate connection id")
+	}
+
+	if err = pending.fulfill("B", &DataConnection{}); err != errUnmatchedConnection {
+		t.Fatalf("expected unmatched error, got %v", err)
+	}
+
+	connection := &DataConnection{}
+	if err = pending.fulfill("A", connection); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := <-resultChan; result.connection != connection {
+		t.Fatal("received wrong data connection")
+	}
+
+	if err = pending.fulfill("A", &DataConnection{}); err != errDuplicateConnection {
+		t.Fatalf("expected duplicate error, got %v", err)
+	}
+}
+
+func TestPendingRequestsExpire(t *testing.T) {
+	pending := newPendingRequests(time.Second)
+
+	if _, err := pending.add("A"); err != nil {
+		t.Fatal(err)
+	}
+
+	pending.expire("A")
+
+	serverSide, agentSide := net.Pipe()
+	defer agentSide.Close()
+
+	if err := pending.fulfill("A", &DataConnection{raw: &RawConnection{Conn: serverSide}}); err != errExpiredConnection {
+		t.Fatalf("expected expired error, got %v", err)
+	}
+
+	_ = agentSide.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := agentSide.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the rejected data connection closed, got %v", err)
+	}
+}
+
+func TestPendingRequestsExpireClosesLateConnection(t *testing.T) {
+	pending := newPendingRequests(time.Second)
+
+	if _, err := pending.add("A"); err != nil {
+		t.Fatal(err)
+	}
+
+	serverSide, agentSide := net.Pipe()
+	defer agentSide.Close()
+
+	if err := pending.fulfill("A", &DataConnection{raw: &RawConnection{Conn: serverSide}}); err != nil {
+		t.Fatal(err)
+	}
+	pending.expire("A")
+
+	_ = agentSide.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := agentSide.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the unreceived data connection closed, got %v", err)
+	}
+}
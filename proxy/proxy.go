@@ -2,146 +2,480 @@ package proxy
 
 import (
 	"context"
+	"fmt"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"strings"
+	"time"
+	"tunnel-transporter/auth"
 	"tunnel-transporter/config"
 	"tunnel-transporter/constants"
 	"tunnel-transporter/message"
+	"tunnel-transporter/mux"
+	"tunnel-transporter/traffic"
 	"tunnel-transporter/util"
 )
 
 type Proxy struct {
-	AgentId      string
-	AgentVersion string
+	AgentId        string
+	AgentVersion   string
+	OS             string
+	Arch           string
+	RemoteAddr     string
+	Multiplex      bool
+	ConnectedSince time.Time
+	Metadata       map[string]string
 
-	PublicListener   *net.TCPListener
-	PublicListenPort uint16
+	Tunnels map[string]*Tunnel
 
 	BootstrapConnection *BootstrapConnection
-	Connections         []*DataConnection
-	ConnectionsChan     chan *DataConnection
+	session             *mux.Session
+	pending             *pendingRequests
+	sessionKey          string
 
 	rootContext context.Context
 	rootCancel  context.CancelFunc
 
 	cancel  chan error
 	closing bool
+	closed  chan struct{}
 }
 
-func NewProxy(agentId string, agentVersion string, conn *net.TCPConn, unregisterChan chan<- uint16) (*Proxy, error) {
+func NewProxy(requestMessage message.BootstrapRequestMessage, identity auth.Identity, conn net.Conn, allocator Allocator, unregisterChan chan<- *Proxy) (*Proxy, error) {
 	cancelChan := make(chan error)
 	ctx, cancel := context.WithCancel(context.Background())
 
-	listener, port, err := newListener()
-	if err != nil {
-		log.Errorf("error creating listener, reason: %v", err)
+	tunnelProxy := Proxy{
+		AgentId:        requestMessage.AgentId,
+		AgentVersion:   requestMessage.AgentVersion,
+		OS:             requestMessage.OS,
+		Arch:           requestMessage.Arch,
+		RemoteAddr:     conn.RemoteAddr().String(),
+		Multiplex:      requestMessage.Multiplex,
+		ConnectedSince: time.Now(),
+		Metadata:       identity.Metadata,
+		Tunnels:        map[string]*Tunnel{},
+		pending:        newPendingRequests(config.Get().Server.ConnectionTimeout),
+		rootContext:    ctx,
+		rootCancel:     cancel,
+		cancel:         cancelChan,
+		closed:         make(chan struct{}),
+	}
+
+	abort := func(err error) (*Proxy, error) {
 		cancel()
 		close(cancelChan)
+		tunnelProxy.closeTunnels()
+		for _, tunnel := range tunnelProxy.Tunnels {
+			allocator.ReleasePort(tunnel)
+			allocator.ReleaseHosts(tunnel)
+		}
 		return nil, err
 	}
 
-	log.Infof("starting tunnel for agent %s, using port %d", agentId, port)
+	tunnels, tunnelMetadata, err := reviewTunnels(identity, requestMessage.Tunnels)
+	if err != nil {
+		return abort(err)
+	}
 
-	tunnelProxy := Proxy{
-		AgentId:             agentId,
-		AgentVersion:        agentVersion,
-		PublicListener:      listener,
-		PublicListenPort:    uint16(port),
-		BootstrapConnection: NewBootstrapConnection(ctx, cancelChan, conn, true),
-		Connections:         []*DataConnection{},
-		ConnectionsChan:     make(chan *DataConnection, 10),
-		rootContext:         ctx,
-		rootCancel:          cancel,
-		cancel:              cancelChan,
-	}
-
-	go tunnelProxy.handlePublicConnection(ctx)
+	if err = validateTunnels(tunnels); err != nil {
+		return abort(err)
+	}
+
+	if err = authorizeTunnels(identity, tunnels); err != nil {
+		return abort(err)
+	}
+
+	if traffic.Manager != nil {
+		for _, tunnel := range tunnels {
+			if err = traffic.Manager.Check(identity.AgentId, tunnel.Name); err != nil {
+				return abort(err)
+			}
+		}
+	}
+
+	responseMessage := message.BootstrapResponseMessage{Multiplex: requestMessage.Multiplex}
+	if identity.Token != "" {
+		responseMessage.SessionNonce = auth.NewNonce()
+		tunnelProxy.sessionKey = auth.SessionKey(identity.Token, identity.Nonce, responseMessage.SessionNonce)
+	}
+
+	for _, definition := range tunnels {
+		tunnel, err := newTunnel(&tunnelProxy, definition, allocator)
+		if err != nil {
+			tunnelProxy.logger().WithField(constants.TunnelField, definition.Name).WithError(err).Error("error creating tunnel")
+			return abort(err)
+		}
+		tunnel.Metadata = tunnelMetadata[tunnel.Name]
+
+		tunnelProxy.Tunnels[tunnel.Name] = tunnel
+		responseMessage.Tunnels = append(responseMessage.Tunnels, message.TunnelResponse{
+			Name:       tunnel.Name,
+			PublicPort: tunnel.PublicListenPort,
+			Hosts:      tunnel.Hosts,
+		})
+	}
+
+	if err := util.Write(conn, responseMessage); err != nil {
+		tunnelProxy.logger().WithError(err).Error("error writing bootstrap response")
+		return abort(err)
+	}
+
+	controlConnection := conn
+	if requestMessage.Multiplex {
+		tunnelProxy.session = mux.NewSession(conn, false)
+
+		// an agent never opening the control stream would otherwise keep its ports and hosts claimed
+		timer := time.AfterFunc(HandshakeTimeout, func() {
+			_ = tunnelProxy.session.Close()
+		})
+		controlStream, err := tunnelProxy.session.Accept()
+		if !timer.Stop() {
+			err = errors.New("timeout accepting control stream")
+		}
+		if err != nil {
+			tunnelProxy.logger().WithError(err).Error("error accepting control stream")
+			_ = tunnelProxy.session.Close()
+			return abort(err)
+		}
+		controlConnection = controlStream
+	}
+
+	tunnelProxy.BootstrapConnection = NewBootstrapConnection(ctx, cancelChan, controlConnection, true)
+	go tunnelProxy.drainOnGoAway(ctx)
+
+	for _, tunnel := range tunnelProxy.Tunnels {
+		switch {
+		case tunnel.PublicListener != nil:
+			tunnel.logger().WithField("multiplex", requestMessage.Multiplex).Info("starting tcp tunnel")
+			go tunnel.handlePublicConnection(ctx)
+		case tunnel.PublicPacketConn != nil:
+			tunnel.logger().WithField("multiplex", requestMessage.Multiplex).Info("starting udp tunnel")
+			go tunnel.handlePublicPackets(ctx)
+		default:
+			tunnel.logger().WithFields(log.Fields{constants.HostsField: strings.Join(tunnel.Hosts, ","), "multiplex": requestMessage.Multiplex}).Info("starting host tunnel")
+		}
+	}
 	go tunnelProxy.shutdown(unregisterChan)
 
 	return &tunnelProxy, nil
 }
 
-func newListener() (listener *net.TCPListener, port int, err error) {
-	listener, err = util.ListenOnRandomPort()
-	if err != nil {
-		log.Errorf("error while listening on %s, reason: %v", listener.Addr().String(), err)
-		return nil, 0, err
+// reviewTunnels lets the auth webhook deny or rewrite every requested tunnel, the name of a
+// tunnel can not be changed.
+func reviewTunnels(identity auth.Identity, tunnels []message.TunnelRequest) ([]message.TunnelRequest, map[string]map[string]string, error) {
+	metadata := map[string]map[string]string{}
+	webhook := auth.Webhook()
+	if webhook == nil {
+		return tunnels, metadata, nil
 	}
 
-	_, port = util.ResolveAddress(listener.Addr().String())
-	return
+	var reviewedTunnels []message.TunnelRequest
+	for _, tunnel := range tunnels {
+		content, err := webhook.NewTunnel(auth.NewTunnelContent{
+			AgentId:  identity.AgentId,
+			Tunnel:   tunnel,
+			Metadata: identity.Metadata,
+		})
+		if err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("tunnel %s rejected", tunnel.Name))
+		}
+
+		content.Tunnel.Name = tunnel.Name
+		reviewedTunnels = append(reviewedTunnels, content.Tunnel)
+		metadata[tunnel.Name] = content.Metadata
+	}
+
+	return reviewedTunnels, metadata, nil
 }
 
-func (t *Proxy) handlePublicConnection(ctx context.Context) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Errorf("error handing public connection, reason: %v", err)
+func validateTunnels(tunnels []message.TunnelRequest) error {
+	if len(tunnels) == 0 {
+		return errors.New("no tunnel requested")
+	}
+
+	names := map[string]bool{}
+	for _, tunnel := range tunnels {
+		if tunnel.Name == "" {
+			return errors.New("tunnel name must not be blank")
 		}
-	}()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
+		if names[tunnel.Name] {
+			return errors.New(fmt.Sprintf("duplicate tunnel name %s", tunnel.Name))
+		}
+		names[tunnel.Name] = true
+
+		switch tunnel.Type {
+		case constants.TCP, constants.UDP:
+		case constants.HTTP, constants.HTTPS:
+			if (tunnel.Type == constants.HTTP && config.Get().Server.Http.Port == 0) ||
+				(tunnel.Type == constants.HTTPS && config.Get().Server.Https.Port == 0) {
+				return errors.New(fmt.Sprintf("%s tunnel %s requires %s to be enabled on server", tunnel.Type, tunnel.Name, tunnel.Type))
+			}
+
+			if tunnel.Subdomain != "" && subdomainHost(tunnel.Type) == "" {
+				return errors.New(fmt.Sprintf("subdomain of tunnel %s requires subdomain-host on server", tunnel.Name))
+			}
+
+			if tunnel.Subdomain == "" && len(tunnel.CustomDomains) == 0 {
+				return errors.New(fmt.Sprintf("%s tunnel %s requires custom-domains or subdomain", tunnel.Type, tunnel.Name))
+			}
 		default:
-			publicConnection, err := t.PublicListener.AcceptTCP()
-			if err != nil {
-				log.Errorf("error while accepting public connection, reason: %v", err)
-				continue
+			return errors.New(fmt.Sprintf("unsupported type %s for tunnel %s", tunnel.Type, tunnel.Name))
+		}
+	}
+
+	return nil
+}
+
+// authorizeTunnels checks the requested tunnels against the names, ports and domains the
+// credentials store allows for the agent, and against the claims of its signed token.
+func authorizeTunnels(identity auth.Identity, tunnels []message.TunnelRequest) error {
+	if identity.Claims != nil {
+		if err := authorizeClaims(identity.Claims, tunnels); err != nil {
+			return err
+		}
+	}
+
+	if auth.Credentials == nil {
+		return nil
+	}
+
+	agentId := identity.AgentId
+	credential, err := auth.Credentials.Check(agentId)
+	if err != nil {
+		return err
+	}
+
+	for _, tunnel := range tunnels {
+		if !credential.AllowsTunnel(tunnel.Name) {
+			return errors.New(fmt.Sprintf("tunnel %s is not allowed for agent %s", tunnel.Name, agentId))
+		}
+
+		switch tunnel.Type {
+		case constants.TCP, constants.UDP:
+			if len(credential.AllowedPorts) != 0 && tunnel.RemotePort == 0 {
+				return errors.New(fmt.Sprintf("tunnel %s requires a remote port allowed for agent %s", tunnel.Name, agentId))
 			}
 
-			go func() {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					t.BootstrapConnection.raw.write(message.RequireNewConnectionRequestMessage{})
-
-					proxyConnection, ok := <-t.ConnectionsChan
-					if !ok {
-						log.Errorf("error reading proxy connection channel, agentId %s", t.AgentId)
-						return
-					}
-
-					log.Debug("public connection connected to proxy connection")
-					proxyConnection.join(publicConnection)
+			if !credential.AllowsPort(tunnel.RemotePort) {
+				return errors.New(fmt.Sprintf("port %d of tunnel %s is not allowed for agent %s", tunnel.RemotePort, tunnel.Name, agentId))
+			}
+		case constants.HTTP, constants.HTTPS:
+			for _, host := range tunnelHosts(tunnel) {
+				if !credential.AllowsHost(host) {
+					return errors.New(fmt.Sprintf("host %s of tunnel %s is not allowed for agent %s", host, tunnel.Name, agentId))
 				}
-			}()
+			}
 		}
 	}
+
+	return nil
 }
 
-func (t *Proxy) HandleNewDataConnection(responseMessage message.RequireNewConnectionResponseMessage, conn *net.TCPConn) {
-	if config.ClientConfig.Server.Authentication.Type == constants.StaticToken {
-		if responseMessage.StaticToken != config.ClientConfig.Server.Authentication.StaticToken.Token {
+func authorizeClaims(claims *auth.Claims, tunnels []message.TunnelRequest) error {
+	if claims.MaxTunnels != 0 && len(tunnels) > claims.MaxTunnels {
+		return errors.New(fmt.Sprintf("token allows at most %d tunnels", claims.MaxTunnels))
+	}
+
+	for _, tunnel := range tunnels {
+		switch tunnel.Type {
+		case constants.TCP, constants.UDP:
+			if claims.Ports != "" && tunnel.RemotePort == 0 {
+				return errors.New(fmt.Sprintf("tunnel %s requires a remote port allowed by token", tunnel.Name))
+			}
+
+			if !claims.AllowsPort(tunnel.RemotePort) {
+				return errors.New(fmt.Sprintf("port %d of tunnel %s is not allowed by token", tunnel.RemotePort, tunnel.Name))
+			}
+		case constants.HTTP, constants.HTTPS:
+			if len(claims.Subdomains) != 0 && len(tunnel.CustomDomains) != 0 {
+				return errors.New(fmt.Sprintf("custom domains of tunnel %s are not allowed by token", tunnel.Name))
+			}
+
+			if tunnel.Subdomain != "" && !claims.AllowsSubdomain(tunnel.Subdomain) {
+				return errors.New(fmt.Sprintf("subdomain %s of tunnel %s is not allowed by token", tunnel.Subdomain, tunnel.Name))
+			}
+		}
+	}
+
+	return nil
+}
+
+// open creates a connection to the local service of the tunnel, either as a stream of the
+// mux session or as a data connection dialed back by the agent.
+func (t *Proxy) open(ctx context.Context, tunnelName string) (net.Conn, error) {
+	if t.session != nil {
+		return t.openStream(tunnelName)
+	}
+
+	return t.openDataConnection(ctx, tunnelName)
+}
+
+func (t *Proxy) openStream(tunnelName string) (net.Conn, error) {
+	stream, err := t.session.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening stream")
+	}
+
+	if err = util.Write(stream, message.StreamOpenMessage{TunnelName: tunnelName}); err != nil {
+		_ = stream.Reset()
+		return nil, errors.Wrap(err, "error writing stream header")
+	}
+
+	t.logger().WithFields(log.Fields{constants.TunnelField: tunnelName, constants.ConnIdField: stream.Id()}).Debug("public connection connected to stream")
+	return stream, nil
+}
+
+func (t *Proxy) openDataConnection(ctx context.Context, tunnelName string) (net.Conn, error) {
+	connectionId := util.RandomId()
+	resultChan, err := t.pending.add(connectionId)
+	if err != nil {
+		return nil, errors.Wrap(err, "error registering pending connection")
+	}
+
+	t.BootstrapConnection.raw.write(message.RequireNewConnectionRequestMessage{
+		ConnectionId: connectionId,
+		TunnelName:   tunnelName,
+	})
+
+	timer := time.NewTimer(t.pending.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		t.pending.expire(connectionId)
+		return nil, errors.New("tunnel closed")
+	case <-timer.C:
+		t.pending.expire(connectionId)
+		return nil, errors.Wrap(errDataConnectionTimeout, connectionId)
+	case result := <-resultChan:
+		if result.err != nil {
+			return nil, errors.Wrap(result.err, fmt.Sprintf("agent failed to create data connection %s", connectionId))
+		}
+
+		t.logger().WithFields(log.Fields{constants.TunnelField: tunnelName, constants.ConnIdField: connectionId}).Debug("public connection connected to data connection")
+		return result.connection.raw.Conn, nil
+	}
+}
+
+// HandleNewDataConnection matches a data connection dialed back by the agent with its pending
+// request. With static-token authentication the connection proves the session key derived
+// during bootstrap, answering the nonce challenged on this connection.
+func (t *Proxy) HandleNewDataConnection(responseMessage message.RequireNewConnectionResponseMessage, nonce string, conn net.Conn) {
+	if auth.Credentials != nil {
+		if _, err := auth.Credentials.Check(t.AgentId); err != nil {
+			t.logger().WithField(constants.ConnIdField, responseMessage.ConnectionId).WithError(err).Warn("rejecting data connection")
 			conn.Close()
+			_ = t.pending.fail(responseMessage.ConnectionId, err)
 			return
 		}
 	}
 
-	ctx, _ := context.WithCancel(t.rootContext)
+	if authenticationType := config.Get().Server.Authentication.Type; authenticationType == constants.StaticToken || authenticationType == constants.SignedToken {
+		replayWindow := config.Get().Server.Authentication.StaticToken.ReplayWindow
+		if authenticationType == constants.SignedToken {
+			replayWindow = config.Get().Server.Authentication.SignedToken.ReplayWindow
+		}
+		if err := auth.Verify(t.sessionKey, nonce, responseMessage.AgentId, responseMessage.Timestamp, responseMessage.Proof, replayWindow); err != nil {
+			t.logger().WithField(constants.ConnIdField, responseMessage.ConnectionId).WithError(err).Warn("rejecting data connection")
+			conn.Close()
+			return
+		}
+	}
 
-	newDataConnection := NewDataConnection(ctx, t.cancel, conn)
-	t.ConnectionsChan <- newDataConnection
-	t.Connections = append(t.Connections, newDataConnection)
+	if responseMessage.Error != "" {
+		conn.Close()
+		if err := t.pending.fail(responseMessage.ConnectionId, errors.New(responseMessage.Error)); err != nil {
+			t.logger().WithField(constants.ConnIdField, responseMessage.ConnectionId).WithError(err).Warn("rejecting data connection")
+		}
+		return
+	}
+
+	newDataConnection := NewDataConnection(t.rootContext, t.cancel, conn)
+	if err := t.pending.fulfill(responseMessage.ConnectionId, newDataConnection); err != nil {
+		t.logger().WithField(constants.ConnIdField, responseMessage.ConnectionId).WithError(err).Warn("rejecting data connection")
+	}
 }
 
-func (t *Proxy) shutdown(unregisterChan chan<- uint16) {
+// Close shuts the proxy down and waits until all its tunnels are closed.
+func (t *Proxy) Close(reason error) {
+	func() {
+		defer func() {
+			_ = recover()
+		}()
+		t.cancel <- reason
+	}()
+
+	<-t.closed
+}
+
+// Drain tells the agent the server is going away and stops accepting public connections,
+// the connections already joined keep running until they end or the proxy is closed.
+func (t *Proxy) Drain(reason string) {
+	t.BootstrapConnection.GoAway(reason)
+	t.stopAccepting()
+}
+
+// drainOnGoAway stops accepting public connections once the agent announces it is going away.
+func (t *Proxy) drainOnGoAway(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-t.BootstrapConnection.GoingAway():
+		t.logger().WithField("reason", t.BootstrapConnection.GoAwayReason()).Info("agent is going away, draining tunnels")
+		t.stopAccepting()
+	}
+}
+
+func (t *Proxy) stopAccepting() {
+	for _, tunnel := range t.Tunnels {
+		tunnel.stopAccepting()
+	}
+}
+
+// ActiveConnections returns the number of public connections joined over all tunnels.
+func (t *Proxy) ActiveConnections() int {
+	active := 0
+	for _, tunnel := range t.Tunnels {
+		active += tunnel.ActiveConnections()
+	}
+
+	return active
+}
+
+// CloseConnections closes the public connections joined over all tunnels.
+func (t *Proxy) CloseConnections() {
+	for _, tunnel := range t.Tunnels {
+		tunnel.closeConnections()
+	}
+}
+
+func (t *Proxy) closeTunnels() {
+	for _, tunnel := range t.Tunnels {
+		tunnel.close()
+	}
+}
+
+func (t *Proxy) shutdown(unregisterChan chan<- *Proxy) {
 	select {
 	case err := <-t.cancel:
 		if t.closing {
 			return
 		}
 
-		log.Infof("===> shutting down tunnel (agent %s) due to error: %v", t.AgentId, err)
+		t.logger().WithError(err).Info("===> shutting down tunnel")
 
 		t.closing = true
 		t.rootCancel()
-		unregisterChan <- t.PublicListenPort
+		unregisterChan <- t
 		close(t.cancel)
-		t.PublicListener.Close()
-		close(t.ConnectionsChan)
+		t.closeTunnels()
+		if t.session != nil {
+			_ = t.session.Close()
+		}
 
-		log.Infof("===> completed shutting down tunnel (agent %s)", t.AgentId)
+		close(t.closed)
+		t.logger().Info("===> completed shutting down tunnel")
 	}
 }
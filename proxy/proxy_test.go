@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+	"tunnel-transporter/auth"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/message"
+	"tunnel-transporter/util"
+)
+
+// testAllocator opens public sockets on random ports and records the released tunnels.
+type testAllocator struct {
+	released []string
+}
+
+func (a *testAllocator) AllocatePort(agentId string, tunnelName string, requestedPort uint16) (*net.TCPListener, error) {
+	return util.ListenOnRandomPort()
+}
+
+func (a *testAllocator) AllocateUdpPort(agentId string, tunnelName string, requestedPort uint16) (*net.UDPConn, error) {
+	return util.ListenUdp(0)
+}
+
+func (a *testAllocator) ReleasePort(tunnel *Tunnel) {
+	a.released = append(a.released, tunnel.Name)
+}
+
+func (a *testAllocator) BindHosts(tunnel *Tunnel) error {
+	return nil
+}
+
+func (a *testAllocator) ReleaseHosts(tunnel *Tunnel) {
+}
+
+func TestValidateTunnels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	if err := ioutil.WriteFile(path, []byte("server:\n  port: 18080\n  http:\n    port: 18081\n    subdomain-host: example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		description string
+		tunnels     []message.TunnelRequest
+		valid       bool
+	}{
+		{"several tunnels", []message.TunnelRequest{
+			{Name: "ssh", Type: constants.TCP, RemotePort: 10022},
+			{Name: "dns", Type: constants.UDP},
+			{Name: "web", Type: constants.HTTP, Subdomain: "web"},
+			{Name: "api", Type: constants.HTTP, CustomDomains: []string{"api.example.org"}},
+		}, true},
+		{"no tunnel", nil, false},
+		{"blank name", []message.TunnelRequest{{Type: constants.TCP}}, false},
+		{"duplicate name", []message.TunnelRequest{{Name: "ssh", Type: constants.TCP}, {Name: "ssh", Type: constants.UDP}}, false},
+		{"unsupported type", []message.TunnelRequest{{Name: "ssh", Type: "sctp"}}, false},
+		{"http without host", []message.TunnelRequest{{Name: "web", Type: constants.HTTP}}, false},
+		{"https not enabled", []message.TunnelRequest{{Name: "web", Type: constants.HTTPS, CustomDomains: []string{"web.example.org"}}}, false},
+	}
+
+	for _, c := range cases {
+		if err := validateTunnels(c.tunnels); (err == nil) != c.valid {
+			t.Fatalf("expected %s to be valid %t, got %v", c.description, c.valid, err)
+		}
+	}
+}
+
+func TestNewProxyControlStreamTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	if err := ioutil.WriteFile(path, []byte("server:\n  port: 18080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(timeout time.Duration) {
+		HandshakeTimeout = timeout
+	}(HandshakeTimeout)
+	HandshakeTimeout = 200 * time.Millisecond
+
+	// the agent reads the bootstrap response but never opens the control stream
+	serverSide, agentSide := net.Pipe()
+	defer agentSide.Close()
+	go func() {
+		_, _ = util.Read(agentSide)
+		_, _ = ioutil.ReadAll(agentSide)
+	}()
+
+	requestMessage := message.BootstrapRequestMessage{
+		AgentId:   "ABC",
+		Multiplex: true,
+		Tunnels:   []message.TunnelRequest{{Name: "echo", Type: constants.TCP}},
+	}
+
+	allocator := &testAllocator{}
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewProxy(requestMessage, auth.Identity{AgentId: "ABC"}, serverSide, allocator, make(chan *Proxy, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected proxy without control stream to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected accepting the control stream to time out")
+	}
+
+	if len(allocator.released) != 1 || allocator.released[0] != "echo" {
+		t.Fatalf("expected port of the tunnel to be released, got %v", allocator.released)
+	}
+}
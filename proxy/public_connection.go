@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+	"tunnel-transporter/util"
+)
+
+// Ways a public connection is closed by the server instead of by either side of the join.
+const (
+	adminClose int32 = iota + 1
+	shutdownClose
+)
+
+// PublicConnection is a public connection joined with the local service of a tunnel.
+type PublicConnection struct {
+	Id         string
+	RemoteAddr string
+	Since      time.Time
+
+	closer io.Closer
+	closed int32
+}
+
+func (p *PublicConnection) close(kind int32) {
+	atomic.StoreInt32(&p.closed, kind)
+	_ = p.closer.Close()
+}
+
+func (p *PublicConnection) closeKind() int32 {
+	return atomic.LoadInt32(&p.closed)
+}
+
+// track registers a joined public connection until the returned release is called, closer
+// is closed when the connection is closed by CloseConnection.
+func (t *Tunnel) track(remoteAddr net.Addr, closer io.Closer) (connection *PublicConnection, release func()) {
+	connection = &PublicConnection{
+		Id:         util.RandomId(),
+		RemoteAddr: remoteAddr.String(),
+		Since:      time.Now(),
+		closer:     closer,
+	}
+
+	t.connectionLock.Lock()
+	if t.connections == nil {
+		t.connections = map[string]*PublicConnection{}
+	}
+	t.connections[connection.Id] = connection
+	t.connectionLock.Unlock()
+
+	return connection, func() {
+		t.connectionLock.Lock()
+		defer t.connectionLock.Unlock()
+
+		delete(t.connections, connection.Id)
+	}
+}
+
+// Connections returns the public connections currently joined, oldest first.
+func (t *Tunnel) Connections() []PublicConnection {
+	t.connectionLock.Lock()
+	connections := make([]PublicConnection, 0, len(t.connections))
+	for _, connection := range t.connections {
+		connections = append(connections, *connection)
+	}
+	t.connectionLock.Unlock()
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Since.Before(connections[j].Since)
+	})
+
+	return connections
+}
+
+// CloseConnection closes the joined public connection with the given id, false when there is none.
+func (t *Tunnel) CloseConnection(id string) bool {
+	t.connectionLock.Lock()
+	connection, ok := t.connections[id]
+	t.connectionLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	connection.close(adminClose)
+	return true
+}
+
+// closeConnections closes every joined public connection of the tunnel.
+func (t *Tunnel) closeConnections() {
+	t.connectionLock.Lock()
+	defer t.connectionLock.Unlock()
+
+	for _, connection := range t.connections {
+		connection.close(shutdownClose)
+	}
+}
+
+// ActiveConnections returns the number of open public connections.
+func (t *Tunnel) ActiveConnections() int {
+	t.connectionLock.Lock()
+	defer t.connectionLock.Unlock()
+
+	return len(t.connections)
+}
+
+// Bytes returns the bytes passed towards the local service and back from it.
+func (t *Tunnel) Bytes() (in uint64, out uint64) {
+	return atomic.LoadUint64(&t.bytesIn), atomic.LoadUint64(&t.bytesOut)
+}
+
+// countBytes returns a counter of the bytes passing the tunnel in the given direction.
+func (t *Tunnel) countBytes(direction string) func(n int) {
+	total := &t.bytesOut
+	if direction == directionIn {
+		total = &t.bytesIn
+	}
+
+	counter := countBytes(t.AgentId, t.Name, direction)
+	return func(n int) {
+		atomic.AddUint64(total, uint64(n))
+		counter(n)
+	}
+}
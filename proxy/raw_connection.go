@@ -4,6 +4,7 @@ import (
 	"context"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"sync"
 	"tunnel-transporter/message"
 	"tunnel-transporter/util"
 )
@@ -11,6 +12,8 @@ import (
 type RawConnection struct {
 	net.Conn
 	cancel chan<- error
+
+	writeLock sync.Mutex
 }
 
 func NewRawConnection(ctx context.Context, cancel chan<- error, conn net.Conn) *RawConnection {
@@ -35,12 +38,15 @@ func NewRawConnection(ctx context.Context, cancel chan<- error, conn net.Conn) *
 func (r *RawConnection) write(typedMessage message.TypedMessage) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Warnf("error writing raw connection, reason: %v", err)
+			log.WithField("reason", err).Warn("error writing raw connection")
 		}
 	}()
 
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
 	if err := util.Write(r.Conn, typedMessage); err != nil {
-		log.Errorf("error writing raw connection, reason: %v", err)
+		log.WithError(err).Error("error writing raw connection")
 		r.cancel <- err
 	}
 }
@@ -48,13 +54,13 @@ func (r *RawConnection) write(typedMessage message.TypedMessage) {
 func (r *RawConnection) read() message.TypedMessage {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Warnf("error reading raw connection, reason: %v", err)
+			log.WithField("reason", err).Warn("error reading raw connection")
 		}
 	}()
 
 	receivedMessage, err := util.Read(r.Conn)
 	if err != nil {
-		log.Errorf("error reading raw connection, reason: %v", err)
+		log.WithError(err).Error("error reading raw connection")
 		r.cancel <- err
 		return nil
 	}
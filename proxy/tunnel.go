@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnel-transporter/access"
+	"tunnel-transporter/accesslog"
+	"tunnel-transporter/auth"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/message"
+	"tunnel-transporter/traffic"
+	"tunnel-transporter/util"
+)
+
+type Tunnel struct {
+	AgentId string
+	Name    string
+	Type    constants.TunnelType
+
+	PublicListener   *net.TCPListener
+	PublicPacketConn *net.UDPConn
+	PublicListenPort uint16
+
+	Hosts    []string
+	Metadata map[string]string
+	Limits   message.TunnelLimits
+
+	proxy             *Proxy
+	draining          int32
+	deniedConnections uint64
+	limiter           *connectionLimiter
+	udpSessions       map[string]*udpSession
+	udpLock           sync.Mutex
+
+	bytesIn        uint64
+	bytesOut       uint64
+	connections    map[string]*PublicConnection
+	connectionLock sync.Mutex
+}
+
+// Allocator hands out the public resources of tunnels. AllocatePort and AllocateUdpPort
+// open the public socket, on the requested port when requestedPort is not zero. BindHosts claims
+// the host names of a tunnel for routing on the shared server listeners. ReleasePort and
+// ReleaseHosts give them back when the tunnel is not started after all.
+type Allocator interface {
+	AllocatePort(agentId string, tunnelName string, requestedPort uint16) (*net.TCPListener, error)
+	AllocateUdpPort(agentId string, tunnelName string, requestedPort uint16) (*net.UDPConn, error)
+	ReleasePort(tunnel *Tunnel)
+	BindHosts(tunnel *Tunnel) error
+	ReleaseHosts(tunnel *Tunnel)
+}
+
+func newTunnel(tunnelProxy *Proxy, definition message.TunnelRequest, allocator Allocator) (*Tunnel, error) {
+	tunnel := &Tunnel{
+		AgentId: tunnelProxy.AgentId,
+		Name:    definition.Name,
+		Type:    definition.Type,
+		Limits:  effectiveLimits(config.Get().Server.Limits, definition.Limits),
+		proxy:   tunnelProxy,
+	}
+	tunnel.limiter = newConnectionLimiter(tunnel.Limits)
+
+	if definition.Type == constants.HTTP || definition.Type == constants.HTTPS {
+		tunnel.Hosts = tunnelHosts(definition)
+		if err := allocator.BindHosts(tunnel); err != nil {
+			return nil, err
+		}
+
+		return tunnel, nil
+	}
+
+	if definition.Type == constants.UDP {
+		packetConn, err := allocator.AllocateUdpPort(tunnelProxy.AgentId, definition.Name, definition.RemotePort)
+		if err != nil {
+			return nil, err
+		}
+
+		_, port := util.ResolveAddress(packetConn.LocalAddr().String())
+		tunnel.PublicPacketConn = packetConn
+		tunnel.PublicListenPort = uint16(port)
+		tunnel.udpSessions = map[string]*udpSession{}
+
+		return tunnel, nil
+	}
+
+	listener, err := allocator.AllocatePort(tunnelProxy.AgentId, definition.Name, definition.RemotePort)
+	if err != nil {
+		return nil, err
+	}
+
+	_, port := util.ResolveAddress(listener.Addr().String())
+	tunnel.PublicListener = listener
+	tunnel.PublicListenPort = uint16(port)
+
+	return tunnel, nil
+}
+
+func tunnelHosts(definition message.TunnelRequest) []string {
+	var hosts []string
+	for _, domain := range definition.CustomDomains {
+		hosts = append(hosts, util.NormalizeHost(domain))
+	}
+
+	if definition.Subdomain != "" {
+		hosts = append(hosts, util.NormalizeHost(definition.Subdomain+"."+subdomainHost(definition.Type)))
+	}
+
+	return hosts
+}
+
+func subdomainHost(tunnelType constants.TunnelType) string {
+	if tunnelType == constants.HTTPS {
+		return config.Get().Server.Https.SubdomainHost
+	}
+
+	return config.Get().Server.Http.SubdomainHost
+}
+
+func (t *Tunnel) handlePublicConnection(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			t.logger().WithField("reason", err).Error("error handing public connection")
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			publicConnection, err := t.PublicListener.AcceptTCP()
+			if err != nil {
+				if t.isDraining() {
+					return
+				}
+				t.logger().WithError(err).Error("error while accepting public connection")
+				continue
+			}
+
+			go func() {
+				select {
+				case <-ctx.Done():
+					publicConnection.Close()
+				default:
+					t.Forward(publicConnection)
+				}
+			}()
+		}
+	}
+}
+
+// open creates a new connection to the local service behind the tunnel.
+func (t *Tunnel) open() (net.Conn, error) {
+	if t.isDraining() {
+		countConnection(t.AgentId, t.Name, connectionRefused)
+		return nil, errTunnelDraining
+	}
+
+	start := time.Now()
+
+	backendConnection, err := t.proxy.open(t.proxy.rootContext, t.Name)
+	if err != nil {
+		countConnection(t.AgentId, t.Name, connectionFailed)
+		return nil, err
+	}
+
+	dataConnectionSetup.Observe(time.Since(start).Seconds())
+	return backendConnection, nil
+}
+
+// join joins the public connection, accepted at start, with the connection to the local
+// service until either side closes, counting the bytes passing each way.
+func (t *Tunnel) join(backendConnection net.Conn, publicConnection net.Conn, start time.Time) {
+	countConnection(t.AgentId, t.Name, connectionAccepted)
+
+	connection, release := t.track(publicConnection.RemoteAddr(), publicConnection)
+	defer release()
+
+	var bytesUp, bytesDown uint64
+	countIn, countOut := t.countBytes(directionIn), t.countBytes(directionOut)
+	closedBy, err := util.JoinCounted(backendConnection, publicConnection, func(n int) {
+		bytesUp += uint64(n)
+		countIn(n)
+	}, func(n int) {
+		bytesDown += uint64(n)
+		countOut(n)
+	})
+
+	reason := closeReason(connection, publicConnection, closedBy, err)
+	if reason == accesslog.AdminClosed || reason == accesslog.Shutdown {
+		err = nil
+	}
+
+	t.logAccess(accesslog.Record{
+		Start:      start,
+		RemoteAddr: connection.RemoteAddr,
+		BytesUp:    bytesUp,
+		BytesDown:  bytesDown,
+		Reason:     reason,
+	}, err)
+}
+
+// Forward joins the public connection with a new connection to the local service.
+func (t *Tunnel) Forward(publicConnection net.Conn) {
+	t.ForwardWith(publicConnection, nil)
+}
+
+// ForwardWith is Forward letting the listener of the public connection answer its client.
+// onBackend, when not nil, gets the connection to the local service and returns the one to
+// join in its place, or gets the error when the public connection is turned away before it is
+// closed: ErrAccessDenied or ErrConnectionRefused as cause when it did not pass the checks,
+// otherwise the error opening the connection to the local service.
+func (t *Tunnel) ForwardWith(publicConnection net.Conn, onBackend func(backendConnection net.Conn, err error) net.Conn) {
+	start := time.Now()
+	turnAway := func(err error) {
+		if onBackend != nil {
+			onBackend(nil, err)
+		}
+		publicConnection.Close()
+	}
+
+	if !t.admit(publicConnection.RemoteAddr()) {
+		t.deny(publicConnection, start, nil)
+		turnAway(ErrAccessDenied)
+		return
+	}
+
+	remoteIp := util.AddressIp(publicConnection.RemoteAddr())
+	if err := t.limiter.acquire(remoteIp); err != nil {
+		countConnection(t.AgentId, t.Name, connectionRefused)
+		t.logger().WithField(constants.RemoteAddrField, publicConnection.RemoteAddr().String()).WithError(err).Warn("refusing public connection")
+		t.deny(publicConnection, start, err)
+		turnAway(errors.Wrap(ErrConnectionRefused, err.Error()))
+		return
+	}
+	defer t.limiter.release(remoteIp)
+
+	if err := t.reviewConnection(publicConnection.RemoteAddr()); err != nil {
+		countConnection(t.AgentId, t.Name, connectionRejected)
+		t.logger().WithField(constants.RemoteAddrField, publicConnection.RemoteAddr().String()).WithError(err).Warn("rejecting public connection")
+		t.deny(publicConnection, start, err)
+		if errors.Cause(err) == auth.ErrDenied {
+			turnAway(errors.Wrap(ErrAccessDenied, err.Error()))
+		} else {
+			turnAway(errors.Wrap(ErrConnectionRefused, err.Error()))
+		}
+		return
+	}
+
+	if err := t.checkQuota(); err != nil {
+		countConnection(t.AgentId, t.Name, connectionRefused)
+		t.logger().WithField(constants.RemoteAddrField, publicConnection.RemoteAddr().String()).WithError(err).Warn("refusing public connection")
+		t.deny(publicConnection, start, err)
+		turnAway(errors.Wrap(ErrConnectionRefused, err.Error()))
+		return
+	}
+
+	backendConnection, err := t.open()
+	if err != nil {
+		t.logger().WithField(constants.RemoteAddrField, publicConnection.RemoteAddr().String()).WithError(err).Error("error opening connection to local service")
+		t.fail(publicConnection, start, err)
+		turnAway(err)
+		return
+	}
+
+	backendConnection = t.meter(backendConnection)
+	if onBackend != nil {
+		backendConnection = onBackend(backendConnection, nil)
+	}
+
+	t.join(backendConnection, publicConnection, start)
+}
+
+func (t *Tunnel) checkQuota() error {
+	if traffic.Manager == nil {
+		return nil
+	}
+
+	return traffic.Manager.Check(t.AgentId, t.Name)
+}
+
+// meter throttles and accounts the traffic passing the connection to the agent.
+func (t *Tunnel) meter(backendConnection net.Conn) net.Conn {
+	if traffic.Manager == nil {
+		return backendConnection
+	}
+
+	return traffic.Manager.Wrap(t.AgentId, t.Name, backendConnection)
+}
+
+// reviewConnection asks the auth webhook whether a public connection is allowed, when
+// configured to review public connections.
+func (t *Tunnel) reviewConnection(remoteAddr net.Addr) error {
+	webhook := auth.Webhook()
+	if webhook == nil || !config.Get().Server.Authentication.Webhook.PublicConnections {
+		return nil
+	}
+
+	return webhook.NewConnection(auth.NewConnectionContent{
+		AgentId:    t.AgentId,
+		TunnelName: t.Name,
+		TunnelType: string(t.Type),
+		RemoteIp:   util.AddressIp(remoteAddr).String(),
+	})
+}
+
+// admit checks the remote ip of a public connection against the access control lists,
+// denied attempts are logged and counted.
+func (t *Tunnel) admit(remoteAddr net.Addr) bool {
+	if access.Control == nil || access.Control.Allows(t.AgentId, t.Name, util.AddressIp(remoteAddr)) {
+		return true
+	}
+
+	atomic.AddUint64(&t.deniedConnections, 1)
+	countConnection(t.AgentId, t.Name, connectionDenied)
+	t.logger().WithField(constants.RemoteAddrField, remoteAddr.String()).Warn("denied public connection")
+	return false
+}
+
+// RefusedConnections returns the number of public connections refused by the limits.
+func (t *Tunnel) RefusedConnections() uint64 {
+	_, refused := t.limiter.stats()
+	return refused
+}
+
+// DeniedConnections returns the number of public connections denied by access control.
+func (t *Tunnel) DeniedConnections() uint64 {
+	return atomic.LoadUint64(&t.deniedConnections)
+}
+
+// stopAccepting closes the public listener of the tunnel and refuses every new public
+// connection, the connections already joined keep running.
+func (t *Tunnel) stopAccepting() {
+	atomic.StoreInt32(&t.draining, 1)
+
+	if t.PublicListener != nil {
+		t.PublicListener.Close()
+	}
+}
+
+func (t *Tunnel) isDraining() bool {
+	return atomic.LoadInt32(&t.draining) == 1
+}
+
+func (t *Tunnel) close() {
+	if t.PublicListener != nil {
+		t.PublicListener.Close()
+	}
+
+	if t.PublicPacketConn != nil {
+		t.PublicPacketConn.Close()
+	}
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+	"tunnel-transporter/access"
+	"tunnel-transporter/config"
+	"tunnel-transporter/config/server"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/message"
+	"tunnel-transporter/mux"
+	"tunnel-transporter/traffic"
+	"tunnel-transporter/util"
+)
+
+// newTcpTunnel starts a tcp tunnel whose agent, multiplexed over a pipe, echoes every stream.
+func newTcpTunnel(t *testing.T, limits message.TunnelLimits) *Tunnel {
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	if err := ioutil.WriteFile(path, []byte("server:\n  port: 18080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	serverSide, agentSide := net.Pipe()
+	agentSession := mux.NewSession(agentSide, true)
+	go func() {
+		for {
+			stream, err := agentSession.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer stream.Close()
+				if _, err := util.Read(stream); err == nil {
+					_, _ = io.Copy(stream, stream)
+				}
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel := &Tunnel{
+		AgentId: "ABC",
+		Name:    "echo",
+		Type:    constants.TCP,
+		Limits:  limits,
+		proxy:   &Proxy{AgentId: "ABC", session: mux.NewSession(serverSide, false), rootContext: ctx},
+		limiter: newConnectionLimiter(limits),
+	}
+	t.Cleanup(func() {
+		cancel()
+		agentSession.Close()
+	})
+
+	return tunnel
+}
+
+// forward passes a loopback connection through the tunnel and returns the error handed to
+// onBackend, nil once the connection is joined with the local service.
+func forward(t *testing.T, tunnel *Tunnel) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	publicConnection, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go tunnel.ForwardWith(publicConnection, func(backendConnection net.Conn, err error) net.Conn {
+		result <- err
+		return backendConnection
+	})
+
+	select {
+	case err = <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected public connection to be forwarded or turned away")
+		return nil
+	}
+}
+
+func TestForwardAccessControl(t *testing.T) {
+	tunnel := newTcpTunnel(t, message.TunnelLimits{})
+
+	if err := forward(t, tunnel); err != nil {
+		t.Fatalf("expected connection to be forwarded, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "access.yaml")
+	if err := ioutil.WriteFile(path, []byte("agents:\n  ABC:\n    tunnels:\n      echo:\n        deny: [127.0.0.1]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	control, err := access.NewAccessControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access.Control = control
+	defer func() {
+		access.Control = nil
+	}()
+
+	if err := forward(t, tunnel); errors.Cause(err) != ErrAccessDenied {
+		t.Fatalf("expected denied source to be turned away, got %v", err)
+	}
+
+	if denied := tunnel.DeniedConnections(); denied != 1 {
+		t.Fatalf("expected 1 denied connection, got %d", denied)
+	}
+}
+
+func TestForwardLimits(t *testing.T) {
+	tunnel := newTcpTunnel(t, message.TunnelLimits{Rate: 0.001, Burst: 1})
+
+	if err := forward(t, tunnel); err != nil {
+		t.Fatalf("expected first connection to be forwarded, got %v", err)
+	}
+
+	if err := forward(t, tunnel); errors.Cause(err) != ErrConnectionRefused {
+		t.Fatalf("expected rate limited connection to be refused, got %v", err)
+	}
+
+	if refused := tunnel.RefusedConnections(); refused != 1 {
+		t.Fatalf("expected 1 refused connection, got %d", refused)
+	}
+}
+
+func TestForwardQuota(t *testing.T) {
+	manager, err := traffic.NewTrafficManager(server.Traffic{
+		StatePath: filepath.Join(t.TempDir(), "state.json"),
+		Agents: map[string]server.AgentTraffic{
+			"ABC": {Tunnels: map[string]server.TrafficPolicy{"echo": {Quota: 10, QuotaPeriod: server.DailyPeriod}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	traffic.Manager = manager
+	defer func() {
+		traffic.Manager = nil
+	}()
+
+	tunnel := newTcpTunnel(t, message.TunnelLimits{})
+	if err := forward(t, tunnel); err != nil {
+		t.Fatalf("expected connection within the quota to be forwarded, got %v", err)
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, remote)
+	}()
+	_, _ = manager.Wrap("ABC", "echo", local).Write(make([]byte, 12))
+
+	if err := forward(t, tunnel); errors.Cause(err) != ErrConnectionRefused {
+		t.Fatalf("expected connection beyond the quota to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/util"
+)
+
+const udpSessionBacklog = 128
+
+// udpSession carries the datagrams of one public remote address over its own tunnel
+// connection, and sends the replies of the local service back to that address.
+type udpSession struct {
+	remoteAddr *net.UDPAddr
+	packets    chan []byte
+	lastActive int64
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive))
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+func (t *Tunnel) handlePublicPackets(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			t.logger().WithField("reason", err).Error("error handing public packets")
+		}
+	}()
+
+	go t.expireUdpSessions(ctx)
+
+	buffer := make([]byte, 65535)
+	for {
+		n, remoteAddr, err := t.PublicPacketConn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				t.logger().WithError(err).Error("error while reading public packet")
+				continue
+			}
+		}
+
+		if !t.hasUdpSession(remoteAddr) && (t.isDraining() || !t.admit(remoteAddr)) {
+			continue
+		}
+
+		payload := make([]byte, n)
+		copy(payload, buffer[:n])
+
+		session := t.getUdpSession(ctx, remoteAddr)
+		session.touch()
+
+		select {
+		case session.packets <- payload:
+		default:
+			t.logger().WithField(constants.RemoteAddrField, remoteAddr.String()).Debug("dropping packet, tunnel is congested")
+		}
+	}
+}
+
+func (t *Tunnel) hasUdpSession(remoteAddr *net.UDPAddr) bool {
+	t.udpLock.Lock()
+	defer t.udpLock.Unlock()
+
+	_, ok := t.udpSessions[remoteAddr.String()]
+	return ok
+}
+
+func (t *Tunnel) getUdpSession(ctx context.Context, remoteAddr *net.UDPAddr) *udpSession {
+	t.udpLock.Lock()
+	defer t.udpLock.Unlock()
+
+	if session, ok := t.udpSessions[remoteAddr.String()]; ok {
+		return session
+	}
+
+	session := &udpSession{
+		remoteAddr: remoteAddr,
+		packets:    make(chan []byte, udpSessionBacklog),
+		closed:     make(chan struct{}),
+	}
+	t.udpSessions[remoteAddr.String()] = session
+
+	go t.serveUdpSession(ctx, session)
+
+	return session
+}
+
+func (t *Tunnel) removeUdpSession(session *udpSession) {
+	session.close()
+
+	t.udpLock.Lock()
+	defer t.udpLock.Unlock()
+
+	if t.udpSessions[session.remoteAddr.String()] == session {
+		delete(t.udpSessions, session.remoteAddr.String())
+	}
+}
+
+func (t *Tunnel) serveUdpSession(ctx context.Context, session *udpSession) {
+	defer t.removeUdpSession(session)
+
+	if err := t.reviewConnection(session.remoteAddr); err != nil {
+		countConnection(t.AgentId, t.Name, connectionRejected)
+		t.logger().WithField(constants.RemoteAddrField, session.remoteAddr.String()).WithError(err).Warn("rejecting udp session")
+		return
+	}
+
+	if err := t.limiter.acquire(session.remoteAddr.IP); err != nil {
+		countConnection(t.AgentId, t.Name, connectionRefused)
+		t.logger().WithField(constants.RemoteAddrField, session.remoteAddr.String()).WithError(err).Warn("refusing udp session")
+		return
+	}
+	defer t.limiter.release(session.remoteAddr.IP)
+
+	if err := t.checkQuota(); err != nil {
+		countConnection(t.AgentId, t.Name, connectionRefused)
+		t.logger().WithField(constants.RemoteAddrField, session.remoteAddr.String()).WithError(err).Warn("refusing udp session")
+		return
+	}
+
+	backendConnection, err := t.open()
+	if err != nil {
+		t.logger().WithField(constants.RemoteAddrField, session.remoteAddr.String()).WithError(err).Error("error opening connection to local service")
+		return
+	}
+	backendConnection = t.meter(backendConnection)
+	defer backendConnection.Close()
+
+	countConnection(t.AgentId, t.Name, connectionAccepted)
+	_, release := t.track(session.remoteAddr, backendConnection)
+	defer release()
+
+	countIn, countOut := t.countBytes(directionIn), t.countBytes(directionOut)
+
+	t.logger().WithField(constants.RemoteAddrField, session.remoteAddr.String()).Debug("udp session opened")
+
+	go func() {
+		defer session.close()
+
+		for {
+			payload, err := util.ReadDatagram(backendConnection)
+			if err != nil {
+				return
+			}
+
+			session.touch()
+			countOut(len(payload))
+			if _, err = t.PublicPacketConn.WriteToUDP(payload, session.remoteAddr); err != nil {
+				t.logger().WithField(constants.RemoteAddrField, session.remoteAddr.String()).WithError(err).Error("error writing packet")
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-session.closed:
+			return
+		case payload := <-session.packets:
+			if err := util.WriteDatagram(backendConnection, payload); err != nil {
+				return
+			}
+			countIn(len(payload))
+		}
+	}
+}
+
+func (t *Tunnel) expireUdpSessions(ctx context.Context) {
+	timeout := config.Get().Server.UdpSessionTimeout
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var expired []*udpSession
+
+			t.udpLock.Lock()
+			for _, session := range t.udpSessions {
+				if time.Since(session.idleSince()) > timeout {
+					expired = append(expired, session)
+				}
+			}
+			t.udpLock.Unlock()
+
+			for _, session := range expired {
+				t.logger().WithField(constants.RemoteAddrField, session.remoteAddr.String()).Debug("udp session expired")
+				t.removeUdpSession(session)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/message"
+	"tunnel-transporter/mux"
+	"tunnel-transporter/util"
+)
+
+// newUdpTunnel starts a udp tunnel whose agent, multiplexed over a pipe, echoes every datagram.
+func newUdpTunnel(t *testing.T, sessionTimeout string) *Tunnel {
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	if err := ioutil.WriteFile(path, []byte("server:\n  port: 18080\n  udp-session-timeout: "+sessionTimeout+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+
+	serverSide, agentSide := net.Pipe()
+	agentSession := mux.NewSession(agentSide, true)
+	go func() {
+		for {
+			stream, err := agentSession.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer stream.Close()
+				if _, err := util.Read(stream); err != nil {
+					return
+				}
+
+				for {
+					payload, err := util.ReadDatagram(stream)
+					if err != nil || util.WriteDatagram(stream, payload) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	packetConn, err := util.ListenUdp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel := &Tunnel{
+		AgentId:          "ABC",
+		Name:             "dns",
+		Type:             constants.UDP,
+		PublicPacketConn: packetConn,
+		proxy:            &Proxy{AgentId: "ABC", session: mux.NewSession(serverSide, false), rootContext: ctx},
+		limiter:          newConnectionLimiter(message.TunnelLimits{}),
+		udpSessions:      map[string]*udpSession{},
+	}
+
+	go tunnel.handlePublicPackets(ctx)
+	t.Cleanup(func() {
+		cancel()
+		packetConn.Close()
+		agentSession.Close()
+	})
+
+	return tunnel
+}
+
+func (t *Tunnel) udpSessionCount() int {
+	t.udpLock.Lock()
+	defer t.udpLock.Unlock()
+
+	return len(t.udpSessions)
+}
+
+func exchangeDatagram(t *testing.T, conn *net.UDPConn, payload string) {
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buffer[:n]) != payload {
+		t.Fatalf("expected echo of %s, got %s", payload, buffer[:n])
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool, description string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUdpSessions(t *testing.T) {
+	tunnel := newUdpTunnel(t, "1m")
+	_, port := util.ResolveAddress(tunnel.PublicPacketConn.LocalAddr().String())
+
+	var clients []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		conn, err := util.DialUdp("127.0.0.1", port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+
+	exchangeDatagram(t, clients[0], "first")
+	exchangeDatagram(t, clients[0], "again")
+	exchangeDatagram(t, clients[1], "second")
+
+	if count := tunnel.udpSessionCount(); count != 2 {
+		t.Fatalf("expected a session per remote address, got %d", count)
+	}
+
+	if active := tunnel.ActiveConnections(); active != 2 {
+		t.Fatalf("expected 2 active sessions, got %d", active)
+	}
+
+	if in, out := tunnel.Bytes(); in != 16 || out != 16 {
+		t.Fatalf("expected 16 bytes each way, got %d in and %d out", in, out)
+	}
+}
+
+func TestUdpSessionExpiry(t *testing.T) {
+	tunnel := newUdpTunnel(t, "200ms")
+	_, port := util.ResolveAddress(tunnel.PublicPacketConn.LocalAddr().String())
+
+	conn, err := util.DialUdp("127.0.0.1", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	exchangeDatagram(t, conn, "ping")
+	waitFor(t, func() bool {
+		return tunnel.udpSessionCount() == 0 && tunnel.ActiveConnections() == 0
+	}, "idle session to expire")
+
+	exchangeDatagram(t, conn, "pong")
+	if count := tunnel.udpSessionCount(); count != 1 {
+		t.Fatalf("expected a new session after expiry, got %d", count)
+	}
+}
@@ -1,65 +1,230 @@
 package registry
 
 import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
 	"sync"
+	"tunnel-transporter/constants"
 	"tunnel-transporter/proxy"
+	"tunnel-transporter/util"
 )
 
+type tunnelKey struct {
+	agentId    string
+	tunnelName string
+}
+
+type hostKey struct {
+	tunnelType constants.TunnelType
+	host       string
+}
+
+// Manager indexes live proxies by agent id, and their tunnels by public port, by
+// (agent id, tunnel name) and by host name.
 type Manager struct {
-	proxies        sync.Map
-	agentIdPortMap sync.Map
-	UnregisterChan chan uint16
+	lock           sync.RWMutex
+	proxies        map[string]*proxy.Proxy
+	tunnels        map[tunnelKey]*proxy.Tunnel
+	portTunnelMap  map[uint16]*proxy.Tunnel
+	hostTunnelMap  map[hostKey]*proxy.Tunnel
+	hostClaims     map[hostKey]*proxy.Tunnel
+	Reservations   *PortReservations
+	UnregisterChan chan *proxy.Proxy
 }
 
 func NewRegistryManager() *Manager {
 	manager := &Manager{
-		UnregisterChan: make(chan uint16, 10),
+		proxies:        map[string]*proxy.Proxy{},
+		tunnels:        map[tunnelKey]*proxy.Tunnel{},
+		portTunnelMap:  map[uint16]*proxy.Tunnel{},
+		hostTunnelMap:  map[hostKey]*proxy.Tunnel{},
+		hostClaims:     map[hostKey]*proxy.Tunnel{},
+		Reservations:   NewPortReservations(),
+		UnregisterChan: make(chan *proxy.Proxy, 10),
 	}
 
+	go manager.unregister()
+
 	return manager
 }
 
-func (m *Manager) Put(publicListenPort uint16, tunnelProxy *proxy.Proxy) {
-	m.proxies.Store(publicListenPort, tunnelProxy)
-	m.agentIdPortMap.Store(tunnelProxy.AgentId, publicListenPort)
+func (m *Manager) Put(tunnelProxy *proxy.Proxy) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if previous, ok := m.proxies[tunnelProxy.AgentId]; ok {
+		m.removeTunnels(previous)
+	}
+
+	m.proxies[tunnelProxy.AgentId] = tunnelProxy
+	for _, tunnel := range tunnelProxy.Tunnels {
+		m.tunnels[tunnelKey{tunnelProxy.AgentId, tunnel.Name}] = tunnel
+		if tunnel.PublicListener != nil {
+			m.portTunnelMap[tunnel.PublicListenPort] = tunnel
+		}
+		for _, host := range tunnel.Hosts {
+			m.hostTunnelMap[hostKey{tunnel.Type, host}] = tunnel
+		}
+	}
 }
 
-func (m *Manager) Remove(publicListenPort uint16) {
-	v, ok := m.proxies.LoadAndDelete(publicListenPort)
-	if !ok {
+// Remove unregisters the proxy, unless the agent already reconnected and was replaced by another
+// proxy, and releases the ports allocated for its tunnels. The ports stay reserved for the agent
+// until their reservation expires.
+func (m *Manager) Remove(tunnelProxy *proxy.Proxy) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, tunnel := range tunnelProxy.Tunnels {
+		m.ReleasePort(tunnel)
+	}
+
+	if current, ok := m.proxies[tunnelProxy.AgentId]; !ok || current != tunnelProxy {
 		return
 	}
 
-	m.agentIdPortMap.Delete(v.(*proxy.Proxy).AgentId)
+	delete(m.proxies, tunnelProxy.AgentId)
+	m.removeTunnels(tunnelProxy)
+}
+
+func (m *Manager) removeTunnels(tunnelProxy *proxy.Proxy) {
+	for _, tunnel := range tunnelProxy.Tunnels {
+		delete(m.tunnels, tunnelKey{tunnelProxy.AgentId, tunnel.Name})
+		if m.portTunnelMap[tunnel.PublicListenPort] == tunnel {
+			delete(m.portTunnelMap, tunnel.PublicListenPort)
+		}
+		for _, host := range tunnel.Hosts {
+			if m.hostTunnelMap[hostKey{tunnel.Type, host}] == tunnel {
+				delete(m.hostTunnelMap, hostKey{tunnel.Type, host})
+			}
+		}
+		m.releaseHosts(tunnel)
+	}
+}
+
+func (m *Manager) AllocatePort(agentId string, tunnelName string, requestedPort uint16) (*net.TCPListener, error) {
+	return m.Reservations.AllocatePort(agentId, tunnelName, requestedPort)
+}
+
+func (m *Manager) AllocateUdpPort(agentId string, tunnelName string, requestedPort uint16) (*net.UDPConn, error) {
+	return m.Reservations.AllocateUdpPort(agentId, tunnelName, requestedPort)
+}
+
+// ReleasePort gives back the public socket of the tunnel, its port stays reserved for the agent.
+func (m *Manager) ReleasePort(tunnel *proxy.Tunnel) {
+	switch {
+	case tunnel.PublicListener != nil:
+		m.Reservations.Release(tunnel.PublicListener)
+	case tunnel.PublicPacketConn != nil:
+		m.Reservations.Release(tunnel.PublicPacketConn)
+	}
+}
+
+// BindHosts claims the hosts of the tunnel until it is removed. It claims none of them when one
+// is already claimed by a tunnel of another agent, a reconnecting agent takes over its own hosts.
+func (m *Manager) BindHosts(tunnel *proxy.Tunnel) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, host := range tunnel.Hosts {
+		if claim, ok := m.hostClaims[hostKey{tunnel.Type, host}]; ok && claim.AgentId != tunnel.AgentId {
+			return errors.New(fmt.Sprintf("host %s is already bound by another agent", host))
+		}
+	}
+
+	for _, host := range tunnel.Hosts {
+		m.hostClaims[hostKey{tunnel.Type, host}] = tunnel
+	}
+
+	return nil
+}
+
+// ReleaseHosts gives back the hosts claimed by the tunnel, unless another tunnel took them over.
+func (m *Manager) ReleaseHosts(tunnel *proxy.Tunnel) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.releaseHosts(tunnel)
+}
+
+func (m *Manager) releaseHosts(tunnel *proxy.Tunnel) {
+	for _, host := range tunnel.Hosts {
+		if m.hostClaims[hostKey{tunnel.Type, host}] == tunnel {
+			delete(m.hostClaims, hostKey{tunnel.Type, host})
+		}
+	}
 }
 
 func (m *Manager) Contains(publicListenPort uint16) bool {
-	_, ok := m.proxies.Load(publicListenPort)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.portTunnelMap[publicListenPort]
 	return ok
 }
 
-func (m *Manager) Get(publicListenPort uint16) *proxy.Proxy {
-	v, ok := m.proxies.Load(publicListenPort)
-	if ok {
-		return v.(*proxy.Proxy)
-	} else {
-		return nil
-	}
+func (m *Manager) Get(publicListenPort uint16) *proxy.Tunnel {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.portTunnelMap[publicListenPort]
 }
 
 func (m *Manager) GetByAgentId(agentId string) *proxy.Proxy {
-	v, ok := m.agentIdPortMap.Load(agentId)
-	if !ok {
-		return nil
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.proxies[agentId]
+}
+
+// Proxies returns a snapshot of the live proxies.
+func (m *Manager) Proxies() []*proxy.Proxy {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	proxies := make([]*proxy.Proxy, 0, len(m.proxies))
+	for _, tunnelProxy := range m.proxies {
+		proxies = append(proxies, tunnelProxy)
 	}
-	return m.Get(v.(uint16))
+
+	return proxies
+}
+
+func (m *Manager) GetTunnel(agentId string, tunnelName string) *proxy.Tunnel {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.tunnels[tunnelKey{agentId, tunnelName}]
+}
+
+// GetByHost finds the tunnel of the given type bound to the host, falling back to wildcard
+// hosts such as *.example.com from the most to the least specific one.
+func (m *Manager) GetByHost(tunnelType constants.TunnelType, host string) *proxy.Tunnel {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	host = util.NormalizeHost(host)
+	if tunnel, ok := m.hostTunnelMap[hostKey{tunnelType, host}]; ok {
+		return tunnel
+	}
+
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels); i++ {
+		if tunnel, ok := m.hostTunnelMap[hostKey{tunnelType, "*." + strings.Join(labels[i:], ".")}]; ok {
+			return tunnel
+		}
+	}
+
+	return nil
 }
 
 func (m *Manager) unregister() {
 	for {
 		select {
-		case port := <-m.UnregisterChan:
-			m.Remove(port)
+		case tunnelProxy := <-m.UnregisterChan:
+			m.Remove(tunnelProxy)
 		}
 	}
 }
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"testing"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/proxy"
+)
+
+func newHostProxy(agentId string, tunnelType constants.TunnelType, hosts ...string) *proxy.Proxy {
+	return &proxy.Proxy{
+		AgentId: agentId,
+		Tunnels: map[string]*proxy.Tunnel{
+			"web": {AgentId: agentId, Name: "web", Type: tunnelType, Hosts: hosts},
+		},
+	}
+}
+
+func TestGetByHost(t *testing.T) {
+	manager := NewRegistryManager()
+	exact := newHostProxy("ABC", constants.HTTP, "web.example.com")
+	wildcard := newHostProxy("DEF", constants.HTTP, "*.example.com")
+	deepWildcard := newHostProxy("GHI", constants.HTTP, "*.api.example.com")
+	secure := newHostProxy("JKL", constants.HTTPS, "web.example.com")
+	for _, tunnelProxy := range []*proxy.Proxy{exact, wildcard, deepWildcard, secure} {
+		if err := manager.BindHosts(tunnelProxy.Tunnels["web"]); err != nil {
+			t.Fatal(err)
+		}
+		manager.Put(tunnelProxy)
+	}
+
+	cases := []struct {
+		tunnelType constants.TunnelType
+		host       string
+		expected   *proxy.Proxy
+	}{
+		{constants.HTTP, "web.example.com", exact},
+		{constants.HTTP, "WEB.example.com:80", exact},
+		{constants.HTTP, "other.example.com", wildcard},
+		{constants.HTTP, "v1.api.example.com", deepWildcard},
+		{constants.HTTP, "a.b.example.com", wildcard},
+		{constants.HTTP, "example.com", nil},
+		{constants.HTTP, "example.org", nil},
+		{constants.HTTPS, "web.example.com", secure},
+		{constants.HTTPS, "other.example.com", nil},
+	}
+
+	for _, c := range cases {
+		tunnel := manager.GetByHost(c.tunnelType, c.host)
+		if c.expected == nil {
+			if tunnel != nil {
+				t.Fatalf("expected no %s tunnel for %s, got agent %s", c.tunnelType, c.host, tunnel.AgentId)
+			}
+			continue
+		}
+
+		if tunnel != c.expected.Tunnels["web"] {
+			t.Fatalf("expected %s tunnel for %s of agent %s, got %v", c.tunnelType, c.host, c.expected.AgentId, tunnel)
+		}
+	}
+}
+
+func TestBindHosts(t *testing.T) {
+	manager := NewRegistryManager()
+	first := newHostProxy("ABC", constants.HTTP, "web.example.com")
+	if err := manager.BindHosts(first.Tunnels["web"]); err != nil {
+		t.Fatal(err)
+	}
+
+	conflicting := newHostProxy("DEF", constants.HTTP, "api.example.com", "web.example.com")
+	if err := manager.BindHosts(conflicting.Tunnels["web"]); err == nil {
+		t.Fatal("expected host bound by another agent to conflict")
+	}
+
+	if err := manager.BindHosts(newHostProxy("GHI", constants.HTTP, "api.example.com").Tunnels["web"]); err != nil {
+		t.Fatalf("expected conflicting bind to claim no host, got %v", err)
+	}
+
+	if err := manager.BindHosts(newHostProxy("DEF", constants.HTTPS, "web.example.com").Tunnels["web"]); err != nil {
+		t.Fatalf("expected https host to be bound independently, got %v", err)
+	}
+
+	manager.Put(first)
+	reconnected := newHostProxy("ABC", constants.HTTP, "web.example.com")
+	if err := manager.BindHosts(reconnected.Tunnels["web"]); err != nil {
+		t.Fatalf("expected reconnecting agent to take over its host, got %v", err)
+	}
+	manager.Put(reconnected)
+
+	manager.Remove(first)
+	if err := manager.BindHosts(newHostProxy("DEF", constants.HTTP, "web.example.com").Tunnels["web"]); err == nil {
+		t.Fatal("expected host to stay bound to the reconnected agent")
+	}
+
+	manager.Remove(reconnected)
+	if manager.GetByHost(constants.HTTP, "web.example.com") != nil {
+		t.Fatal("expected removed tunnel not to be routed")
+	}
+
+	if err := manager.BindHosts(newHostProxy("DEF", constants.HTTP, "web.example.com").Tunnels["web"]); err != nil {
+		t.Fatalf("expected host of removed agent to be released, got %v", err)
+	}
+}
+
+func TestReleaseHosts(t *testing.T) {
+	manager := NewRegistryManager()
+	tunnel := newHostProxy("ABC", constants.HTTP, "web.example.com").Tunnels["web"]
+	if err := manager.BindHosts(tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	manager.ReleaseHosts(tunnel)
+	if err := manager.BindHosts(newHostProxy("DEF", constants.HTTP, "web.example.com").Tunnels["web"]); err != nil {
+		t.Fatalf("expected host of tunnel not started to be released, got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+	"tunnel-transporter/config"
+	"tunnel-transporter/util"
+)
+
+const randomPortAttempts = 100
+
+type portKey struct {
+	network string
+	port    uint16
+}
+
+// listenFunc listens on the given port, or on a random port when port is zero.
+type listenFunc func(port int) (io.Closer, net.Addr, error)
+
+// reservation is the port pinned to a tunnel of an agent, holders counts the open sockets
+// allocated on it. Once the last one is released the reservation expires after the ttl.
+type reservation struct {
+	port     portKey
+	holders  int
+	expireAt time.Time
+}
+
+// PortReservations pins every allocated public port to the agent it was allocated for, so a
+// reconnecting agent gets the same ports back and no other agent can take them. A reservation
+// outlives the tunnel for port-reservation-ttl, or until it is removed through the admin api.
+// Tcp and udp ports are reserved independently.
+type PortReservations struct {
+	lock    sync.Mutex
+	owners  map[portKey]string
+	tunnels map[tunnelKey]*reservation
+	holders map[io.Closer]tunnelKey
+}
+
+func NewPortReservations() *PortReservations {
+	return &PortReservations{
+		owners:  map[portKey]string{},
+		tunnels: map[tunnelKey]*reservation{},
+		holders: map[io.Closer]tunnelKey{},
+	}
+}
+
+func (r *PortReservations) AllocatePort(agentId string, tunnelName string, requestedPort uint16) (*net.TCPListener, error) {
+	listener, err := r.allocate("tcp", agentId, tunnelName, requestedPort, func(port int) (io.Closer, net.Addr, error) {
+		var listener *net.TCPListener
+		var err error
+		if port == 0 {
+			listener, err = util.ListenOnRandomPort()
+		} else {
+			listener, err = util.Listen(port)
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+		return listener, listener.Addr(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return listener.(*net.TCPListener), nil
+}
+
+func (r *PortReservations) AllocateUdpPort(agentId string, tunnelName string, requestedPort uint16) (*net.UDPConn, error) {
+	conn, err := r.allocate("udp", agentId, tunnelName, requestedPort, func(port int) (io.Closer, net.Addr, error) {
+		conn, err := util.ListenUdp(port)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn.LocalAddr(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+func (r *PortReservations) allocate(network string, agentId string, tunnelName string, requestedPort uint16, listen listenFunc) (io.Closer, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.prune()
+
+	key := tunnelKey{agentId, tunnelName}
+	allowedPorts := config.Get().Server.AllowedPorts
+
+	if requestedPort != 0 {
+		if !allowedPorts.Contains(requestedPort) {
+			return nil, errors.New(fmt.Sprintf("%s port %d is not allowed", network, requestedPort))
+		}
+
+		if owner, ok := r.owners[portKey{network, requestedPort}]; ok && owner != agentId {
+			return nil, errors.New(fmt.Sprintf("%s port %d is reserved by another agent", network, requestedPort))
+		}
+
+		listener, _, err := listen(int(requestedPort))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s port %d is already taken", network, requestedPort))
+		}
+
+		r.reserve(key, portKey{network, requestedPort}, listener)
+		return listener, nil
+	}
+
+	if reserved, ok := r.tunnels[key]; ok && reserved.port.network == network && allowedPorts.Contains(reserved.port.port) {
+		if listener, _, err := listen(int(reserved.port.port)); err == nil {
+			r.reserve(key, reserved.port, listener)
+			return listener, nil
+		}
+	}
+
+	listener, port, err := r.listenOnRandomPort(network, agentId, listen)
+	if err != nil {
+		return nil, err
+	}
+
+	r.reserve(key, portKey{network, port}, listener)
+	return listener, nil
+}
+
+func (r *PortReservations) listenOnRandomPort(network string, agentId string, listen listenFunc) (io.Closer, uint16, error) {
+	allowedPorts := config.Get().Server.AllowedPorts
+
+	for i := 0; i < randomPortAttempts; i++ {
+		var port uint16
+		if len(allowedPorts) != 0 {
+			port = allowedPorts.Port(rand.Intn(allowedPorts.Size()))
+			if owner, ok := r.owners[portKey{network, port}]; ok && owner != agentId {
+				continue
+			}
+		}
+
+		listener, addr, err := listen(int(port))
+		if err != nil {
+			continue
+		}
+
+		_, listenPort := util.ResolveAddress(addr.String())
+		if owner, ok := r.owners[portKey{network, uint16(listenPort)}]; ok && owner != agentId {
+			listener.Close()
+			continue
+		}
+
+		return listener, uint16(listenPort), nil
+	}
+
+	return nil, 0, errors.New(fmt.Sprintf("no allowed %s port is available", network))
+}
+
+func (r *PortReservations) reserve(key tunnelKey, port portKey, holder io.Closer) {
+	current, ok := r.tunnels[key]
+	if !ok {
+		current = &reservation{}
+		r.tunnels[key] = current
+	} else if current.port != port {
+		delete(r.owners, current.port)
+	}
+
+	for otherKey, other := range r.tunnels {
+		if other.port == port && otherKey != key {
+			delete(r.tunnels, otherKey)
+		}
+	}
+
+	current.port = port
+	current.holders++
+	r.holders[holder] = key
+	r.owners[port] = key.agentId
+}
+
+// prune drops the reservations no socket holds anymore whose ttl elapsed.
+func (r *PortReservations) prune() {
+	now := time.Now()
+	for key, reserved := range r.tunnels {
+		if reserved.holders == 0 && now.After(reserved.expireAt) {
+			r.drop(key, reserved)
+		}
+	}
+}
+
+func (r *PortReservations) drop(key tunnelKey, reserved *reservation) {
+	if r.owners[reserved.port] == key.agentId {
+		delete(r.owners, reserved.port)
+	}
+	delete(r.tunnels, key)
+}
+
+// Release gives back the socket allocated for a tunnel. The port stays reserved for the agent
+// until port-reservation-ttl elapsed without a tunnel of the agent allocating it again.
+func (r *PortReservations) Release(holder io.Closer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key, ok := r.holders[holder]
+	if !ok {
+		return
+	}
+	delete(r.holders, holder)
+
+	if reserved, ok := r.tunnels[key]; ok && reserved.holders > 0 {
+		reserved.holders--
+		if reserved.holders == 0 {
+			reserved.expireAt = time.Now().Add(config.Get().Server.PortReservationTtl)
+		}
+	}
+}
+
+// Remove drops the reservations of the agent not held by a running tunnel and returns how many
+// were dropped.
+func (r *PortReservations) Remove(agentId string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	removed := 0
+	for key, reserved := range r.tunnels {
+		if key.agentId == agentId && reserved.holders == 0 {
+			r.drop(key, reserved)
+			removed++
+		}
+	}
+
+	return removed
+}
@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+	"tunnel-transporter/config"
+	"tunnel-transporter/constants"
+	"tunnel-transporter/proxy"
+	"tunnel-transporter/util"
+)
+
+func parseAllowedPorts(t *testing.T, allowedPorts string, reservationTtl string) {
+	path := filepath.Join(t.TempDir(), "tunnel-config.yaml")
+	content := "server:\n  port: 18080\n  allowed-ports: [" + allowedPorts + "]\n  port-reservation-ttl: " + reservationTtl + "\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.ParseConfig(path, constants.ServerMode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// allocatePort allocates a port and closes its listener, the caller releases the listener.
+func allocatePort(t *testing.T, reservations *PortReservations, agentId string, tunnelName string, requestedPort uint16) (*net.TCPListener, uint16) {
+	listener, err := reservations.AllocatePort(agentId, tunnelName, requestedPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	_, port := util.ResolveAddress(listener.Addr().String())
+	return listener, uint16(port)
+}
+
+func TestPortReservations(t *testing.T) {
+	parseAllowedPorts(t, "41000-41009", "200ms")
+	reservations := NewPortReservations()
+
+	listener, port := allocatePort(t, reservations, "ABC", "echo", 41001)
+	if port != 41001 {
+		t.Fatalf("expected requested port 41001, got %d", port)
+	}
+
+	if _, err := reservations.AllocatePort("ABC", "other", 42000); err == nil {
+		t.Fatal("expected port outside of allowed ports to be refused")
+	}
+
+	if _, err := reservations.AllocatePort("DEF", "echo", 41001); err == nil {
+		t.Fatal("expected port reserved by another agent to be refused")
+	}
+
+	conn, err := reservations.AllocateUdpPort("DEF", "dns", 41001)
+	if err != nil {
+		t.Fatalf("expected udp port to be reserved independently, got %v", err)
+	}
+	conn.Close()
+	reservations.Release(conn)
+
+	reservations.Release(listener)
+	if _, err := reservations.AllocatePort("DEF", "echo", 41001); err == nil {
+		t.Fatal("expected released port to stay reserved until its reservation expires")
+	}
+
+	listener, port = allocatePort(t, reservations, "ABC", "echo", 0)
+	if port != 41001 {
+		t.Fatalf("expected reconnecting agent to get port 41001 back, got %d", port)
+	}
+
+	for i := 0; i < 20; i++ {
+		random, port := allocatePort(t, reservations, "DEF", "random", 0)
+		reservations.Release(random)
+		if port == 41001 {
+			t.Fatal("expected random port to skip the port reserved by another agent")
+		}
+	}
+
+	reservations.Release(listener)
+	time.Sleep(300 * time.Millisecond)
+	if _, port := allocatePort(t, reservations, "DEF", "echo", 41001); port != 41001 {
+		t.Fatalf("expected expired reservation of port 41001 to be allocated, got %d", port)
+	}
+}
+
+func TestRemovePortReservations(t *testing.T) {
+	parseAllowedPorts(t, "41020-41029", "1h")
+	reservations := NewPortReservations()
+
+	held, _ := allocatePort(t, reservations, "ABC", "echo", 41021)
+	released, _ := allocatePort(t, reservations, "ABC", "ssh", 41022)
+	reservations.Release(released)
+
+	if removed := reservations.Remove("ABC"); removed != 1 {
+		t.Fatalf("expected only the released reservation to be removed, got %d", removed)
+	}
+
+	if _, port := allocatePort(t, reservations, "DEF", "ssh", 41022); port != 41022 {
+		t.Fatalf("expected removed reservation of port 41022 to be allocated, got %d", port)
+	}
+
+	if _, err := reservations.AllocatePort("DEF", "echo", 41021); err == nil {
+		t.Fatal("expected port held by a running tunnel to stay reserved")
+	}
+	reservations.Release(held)
+}
+
+func newAllocatedProxy(t *testing.T, manager *Manager, agentId string, tunnelName string, requestedPort uint16) *proxy.Proxy {
+	listener, port := allocatePort(t, manager.Reservations, agentId, tunnelName, requestedPort)
+	return &proxy.Proxy{
+		AgentId: agentId,
+		Tunnels: map[string]*proxy.Tunnel{
+			tunnelName: {AgentId: agentId, Name: tunnelName, Type: constants.TCP, PublicListener: listener, PublicListenPort: port},
+		},
+	}
+}
+
+func TestRemoveKeepsReservations(t *testing.T) {
+	parseAllowedPorts(t, "41010-41019", "200ms")
+	manager := NewRegistryManager()
+
+	previous := newAllocatedProxy(t, manager, "ABC", "echo", 41011)
+	manager.Put(previous)
+
+	// the agent reconnects: the previous proxy is closed and the new one allocates its ports
+	// before the previous one is removed from the registry
+	reconnected := newAllocatedProxy(t, manager, "ABC", "echo", 0)
+	if port := reconnected.Tunnels["echo"].PublicListenPort; port != 41011 {
+		t.Fatalf("expected reconnecting agent to get port 41011 back, got %d", port)
+	}
+
+	manager.Remove(previous)
+	if _, err := manager.AllocatePort("DEF", "echo", 41011); err == nil {
+		t.Fatal("expected late removal of the previous proxy to keep the port reserved")
+	}
+
+	manager.Put(reconnected)
+	manager.Remove(reconnected)
+	if _, err := manager.AllocatePort("DEF", "echo", 41011); err == nil {
+		t.Fatal("expected port to stay reserved for the disconnected agent")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	listener, err := manager.AllocatePort("DEF", "echo", 41011)
+	if err != nil {
+		t.Fatalf("expected port to be allocated once its reservation expired, got %v", err)
+	}
+	listener.Close()
+}
@@ -0,0 +1,189 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"tunnel-transporter/constants"
+)
+
+const (
+	Connecting   = "connecting"
+	Connected    = "connected"
+	Disconnected = "disconnected"
+	Reconnecting = "reconnecting"
+
+	unixPrefix = "unix:"
+)
+
+// Status is the state of an agent as served by its status api.
+type Status struct {
+	AgentId        string
+	ServerEndpoint string
+	State          string
+	ConnectedSince time.Time
+	RoundTripTime  time.Duration
+	Reconnects     uint64
+	FailedAttempts int
+	NextAttempt    time.Time
+	Tunnels        []Tunnel
+	History        []Disconnect
+}
+
+type Tunnel struct {
+	Name              string
+	Type              constants.TunnelType
+	LocalEndpoint     string
+	PublicPort        uint16
+	Hosts             []string
+	ActiveConnections int
+}
+
+// Disconnect records why the agent lost its connection to the server.
+type Disconnect struct {
+	Time  time.Time
+	Error string
+}
+
+// Listen opens the status address, either a loopback tcp address or unix:PATH for a unix socket.
+func Listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, unixPrefix) {
+		path := strings.TrimPrefix(address, unixPrefix)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// ValidateAddress checks that the status address is a unix socket or a loopback tcp address.
+func ValidateAddress(address string) error {
+	if strings.HasPrefix(address, unixPrefix) {
+		if strings.TrimPrefix(address, unixPrefix) == "" {
+			return errors.New("status address requires a unix socket path")
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("invalid status address %s", address))
+	}
+
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return errors.New(fmt.Sprintf("invalid status port %s", port))
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New(fmt.Sprintf("status address %s must be a loopback address", address))
+	}
+
+	return nil
+}
+
+// Serve answers GET /status with the status collected on each request.
+func Serve(address string, collect func() Status) {
+	listener, err := Listen(address)
+	if err != nil {
+		log.WithField("address", address).WithError(err).Error("error listening on status address")
+		return
+	}
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/status", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(collect()); err != nil {
+			log.WithError(err).Error("error writing status")
+		}
+	})
+
+	log.WithField("address", address).Info("serving agent status")
+	if err = http.Serve(listener, serveMux); err != nil {
+		log.WithField("address", address).WithError(err).Error("error serving status")
+	}
+}
+
+// Fetch queries the status api of the agent listening on the address.
+func Fetch(address string) (Status, error) {
+	transport := &http.Transport{}
+	if strings.HasPrefix(address, unixPrefix) {
+		path := strings.TrimPrefix(address, unixPrefix)
+		transport.DialContext = func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		}
+		address = "unix"
+	}
+
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	response, err := client.Get("http://" + address + "/status")
+	if err != nil {
+		return Status{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return Status{}, errors.New(fmt.Sprintf("status api answered %s", response.Status))
+	}
+
+	var status Status
+	if err = json.NewDecoder(response.Body).Decode(&status); err != nil {
+		return Status{}, err
+	}
+
+	return status, nil
+}
+
+// Print writes the status as tables.
+func Print(writer io.Writer, status Status) {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintf(table, "Agent:\t%s\n", status.AgentId)
+	_, _ = fmt.Fprintf(table, "Server:\t%s\n", status.ServerEndpoint)
+	_, _ = fmt.Fprintf(table, "State:\t%s\n", status.State)
+	if status.State == Connected {
+		_, _ = fmt.Fprintf(table, "Connected since:\t%s\n", status.ConnectedSince.Local().Format("2006-01-02 15:04:05"))
+		_, _ = fmt.Fprintf(table, "Heartbeat RTT:\t%s\n", status.RoundTripTime)
+	}
+	if status.State == Reconnecting {
+		_, _ = fmt.Fprintf(table, "Failed attempts:\t%d\n", status.FailedAttempts)
+		_, _ = fmt.Fprintf(table, "Next attempt:\t%s\n", status.NextAttempt.Local().Format("2006-01-02 15:04:05"))
+	}
+	_, _ = fmt.Fprintf(table, "Reconnects:\t%d\n", status.Reconnects)
+	_ = table.Flush()
+
+	_, _ = fmt.Fprintln(writer)
+	_, _ = fmt.Fprintln(table, "TUNNEL\tTYPE\tLOCAL\tPUBLIC\tACTIVE")
+	for _, tunnel := range status.Tunnels {
+		public := "-"
+		if len(tunnel.Hosts) > 0 {
+			public = strings.Join(tunnel.Hosts, ",")
+		} else if tunnel.PublicPort != 0 {
+			public = strconv.Itoa(int(tunnel.PublicPort))
+		}
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\n", tunnel.Name, tunnel.Type, tunnel.LocalEndpoint, public, tunnel.ActiveConnections)
+	}
+	_ = table.Flush()
+
+	if len(status.History) == 0 {
+		return
+	}
+
+	_, _ = fmt.Fprintln(writer)
+	_, _ = fmt.Fprintln(table, "DISCONNECTED AT\tREASON")
+	for _, disconnect := range status.History {
+		_, _ = fmt.Fprintf(table, "%s\t%s\n", disconnect.Time.Local().Format("2006-01-02 15:04:05"), disconnect.Error)
+	}
+	_ = table.Flush()
+}
@@ -0,0 +1,60 @@
+package status
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateAddress(t *testing.T) {
+	for address, valid := range map[string]bool{
+		"127.0.0.1:7070":     true,
+		"localhost:7070":     true,
+		"[::1]:7070":         true,
+		"unix:/tmp/tt.sock":  true,
+		"0.0.0.0:7070":       false,
+		"192.168.1.10:7070":  false,
+		"127.0.0.1":          false,
+		"unix:":              false,
+		"127.0.0.1:70000000": false,
+	} {
+		if err := ValidateAddress(address); (err == nil) != valid {
+			t.Fatalf("expected %s valid %t, got %v", address, valid, err)
+		}
+	}
+}
+
+func TestServeAndFetch(t *testing.T) {
+	address := "unix:" + filepath.Join(t.TempDir(), "status.sock")
+	go Serve(address, func() Status {
+		return Status{
+			AgentId: "ABC",
+			State:   Connected,
+			Tunnels: []Tunnel{{Name: "echo", Type: "tcp", LocalEndpoint: "127.0.0.1:8000", PublicPort: 15000, ActiveConnections: 2}},
+		}
+	})
+
+	var status Status
+	var err error
+	for i := 0; i < 50; i++ {
+		if status, err = Fetch(address); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.AgentId != "ABC" || len(status.Tunnels) != 1 || status.Tunnels[0].PublicPort != 15000 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	output := &bytes.Buffer{}
+	Print(output, status)
+	if !strings.Contains(output.String(), "echo") || !strings.Contains(output.String(), "15000") {
+		t.Fatalf("expected tunnel in output, got\n%s", output)
+	}
+}
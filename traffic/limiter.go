@@ -0,0 +1,50 @@
+package traffic
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter throttles a byte stream to rate bytes per second, allowing bursts of one second.
+// Consumers going over the rate are delayed until the bucket is refilled.
+type Limiter struct {
+	rate float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of rate bytes per second, or nil when rate is zero.
+func NewLimiter(rate uint64) *Limiter {
+	if rate == 0 {
+		return nil
+	}
+
+	return &Limiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait consumes n bytes and blocks until they fit into the rate. A nil limiter never blocks.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate) - float64(n)
+	l.last = now
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	time.Sleep(delay)
+}
@@ -0,0 +1,326 @@
+package traffic
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tunnel-transporter/config/server"
+	"tunnel-transporter/constants"
+)
+
+var (
+	// Manager throttles and accounts the traffic of tunnels on the server.
+	Manager *TrafficManager
+
+	ErrQuotaExhausted = errors.New("traffic quota exhausted")
+)
+
+type usage struct {
+	Period string
+	Bytes  uint64
+}
+
+type state struct {
+	Agents  map[string]usage
+	Tunnels map[string]usage
+}
+
+// account throttles and counts the traffic of one agent or one tunnel.
+type account struct {
+	name     string
+	fields   log.Fields
+	upload   *Limiter
+	download *Limiter
+	quota    uint64
+	period   string
+
+	uploadBytes   uint64
+	downloadBytes uint64
+
+	lock  sync.Mutex
+	usage usage
+}
+
+func newAccount(name string, fields log.Fields, policy server.TrafficPolicy, previous usage) *account {
+	period := policy.QuotaPeriod
+	if period == "" {
+		period = server.MonthlyPeriod
+	}
+
+	return &account{
+		name:     name,
+		fields:   fields,
+		upload:   NewLimiter(uint64(policy.Upload)),
+		download: NewLimiter(uint64(policy.Download)),
+		quota:    uint64(policy.Quota),
+		period:   period,
+		usage:    previous,
+	}
+}
+
+// periodKey names the current quota period, a new period starts with an empty usage.
+func periodKey(period string, now time.Time) string {
+	if period == server.DailyPeriod {
+		return now.UTC().Format("2006-01-02")
+	}
+
+	return now.UTC().Format("2006-01")
+}
+
+func periodEnd(period string, now time.Time) time.Time {
+	now = now.UTC()
+	if period == server.DailyPeriod {
+		return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	}
+
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (a *account) rollover(now time.Time) {
+	if key := periodKey(a.period, now); a.usage.Period != key {
+		a.usage = usage{Period: key}
+	}
+}
+
+// add counts n bytes, and fails when the quota of the current period is exhausted.
+func (a *account) add(n int, download bool) error {
+	if download {
+		atomic.AddUint64(&a.downloadBytes, uint64(n))
+	} else {
+		atomic.AddUint64(&a.uploadBytes, uint64(n))
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	a.rollover(now)
+
+	exhausted := a.quota > 0 && a.usage.Bytes >= a.quota
+	a.usage.Bytes += uint64(n)
+
+	if a.quota > 0 && a.usage.Bytes >= a.quota {
+		if !exhausted {
+			log.WithFields(a.fields).WithFields(log.Fields{"quota": a.quota, "until": periodEnd(a.period, now).Format(time.RFC3339)}).Warn("traffic quota exhausted, disabling until the next period")
+		}
+		return a.exhaustedError(now)
+	}
+
+	return nil
+}
+
+func (a *account) check() error {
+	if a.quota == 0 {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	a.rollover(now)
+
+	if a.usage.Bytes >= a.quota {
+		return a.exhaustedError(now)
+	}
+
+	return nil
+}
+
+func (a *account) exhaustedError(now time.Time) error {
+	return errors.Wrap(ErrQuotaExhausted, fmt.Sprintf("%s is disabled until %s", a.name, periodEnd(a.period, now).Format(time.RFC3339)))
+}
+
+func (a *account) snapshot() usage {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.usage
+}
+
+// TrafficManager keeps the accounts of every agent and tunnel, and saves their quota usage
+// to the state file so quotas survive restarts of the server.
+type TrafficManager struct {
+	config    server.Traffic
+	statePath string
+
+	lock     sync.Mutex
+	agents   map[string]*account
+	tunnels  map[string]*account
+	previous state
+}
+
+func NewTrafficManager(config server.Traffic) (*TrafficManager, error) {
+	manager := &TrafficManager{
+		config:    config,
+		statePath: config.StatePath,
+		agents:    map[string]*account{},
+		tunnels:   map[string]*account{},
+		previous:  state{Agents: map[string]usage{}, Tunnels: map[string]usage{}},
+	}
+
+	if manager.statePath == "" {
+		return manager, nil
+	}
+
+	bytes, err := ioutil.ReadFile(manager.statePath)
+	if os.IsNotExist(err) {
+		return manager, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(bytes, &manager.previous); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("error parsing traffic state %s", manager.statePath))
+	}
+
+	return manager, nil
+}
+
+func tunnelKey(agentId string, tunnelName string) string {
+	return agentId + "/" + tunnelName
+}
+
+func (m *TrafficManager) accounts(agentId string, tunnelName string) (*account, *account) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	agent, ok := m.agents[agentId]
+	if !ok {
+		agent = newAccount(fmt.Sprintf("agent %s", agentId), log.Fields{constants.AgentIdField: agentId}, m.config.AgentPolicy(agentId), m.previous.Agents[agentId])
+		m.agents[agentId] = agent
+	}
+
+	key := tunnelKey(agentId, tunnelName)
+	tunnel, ok := m.tunnels[key]
+	if !ok {
+		tunnel = newAccount(fmt.Sprintf("tunnel %s of agent %s", tunnelName, agentId), log.Fields{constants.AgentIdField: agentId, constants.TunnelField: tunnelName}, m.config.TunnelPolicy(agentId, tunnelName), m.previous.Tunnels[key])
+		m.tunnels[key] = tunnel
+	}
+
+	return agent, tunnel
+}
+
+// Check fails when the quota of the agent or of the tunnel is exhausted.
+func (m *TrafficManager) Check(agentId string, tunnelName string) error {
+	agent, tunnel := m.accounts(agentId, tunnelName)
+	if err := agent.check(); err != nil {
+		return err
+	}
+
+	return tunnel.check()
+}
+
+// Wrap throttles and accounts the traffic of the tunnel passing conn, the connection to the
+// agent. Writes to conn are uploads, reads from conn are downloads.
+func (m *TrafficManager) Wrap(agentId string, tunnelName string, conn net.Conn) net.Conn {
+	agent, tunnel := m.accounts(agentId, tunnelName)
+	return &meteredConnection{Conn: conn, agent: agent, tunnel: tunnel}
+}
+
+// Bytes returns the bytes uploaded to and downloaded from the tunnel since the server started.
+func (m *TrafficManager) Bytes(agentId string, tunnelName string) (uint64, uint64) {
+	_, tunnel := m.accounts(agentId, tunnelName)
+	return atomic.LoadUint64(&tunnel.uploadBytes), atomic.LoadUint64(&tunnel.downloadBytes)
+}
+
+// Persist saves the state file every interval, when configured.
+func (m *TrafficManager) Persist(interval time.Duration) {
+	if m.statePath == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := m.Save(); err != nil {
+			log.WithField("path", m.statePath).WithError(err).Error("error saving traffic state")
+		}
+	}
+}
+
+func (m *TrafficManager) Save() error {
+	if m.statePath == "" {
+		return nil
+	}
+
+	m.lock.Lock()
+	current := state{Agents: map[string]usage{}, Tunnels: map[string]usage{}}
+	for agentId, usage := range m.previous.Agents {
+		current.Agents[agentId] = usage
+	}
+	for key, usage := range m.previous.Tunnels {
+		current.Tunnels[key] = usage
+	}
+	for agentId, agent := range m.agents {
+		current.Agents[agentId] = agent.snapshot()
+	}
+	for key, tunnel := range m.tunnels {
+		current.Tunnels[key] = tunnel.snapshot()
+	}
+	m.lock.Unlock()
+
+	bytes, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temporaryPath := m.statePath + ".tmp"
+	if err = ioutil.WriteFile(temporaryPath, bytes, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, m.statePath)
+}
+
+type meteredConnection struct {
+	net.Conn
+	agent  *account
+	tunnel *account
+}
+
+func (c *meteredConnection) Write(buffer []byte) (int, error) {
+	c.agent.upload.Wait(len(buffer))
+	c.tunnel.upload.Wait(len(buffer))
+
+	n, err := c.Conn.Write(buffer)
+	if quotaErr := c.account(n, false); quotaErr != nil && err == nil {
+		err = quotaErr
+	}
+
+	return n, err
+}
+
+func (c *meteredConnection) Read(buffer []byte) (int, error) {
+	n, err := c.Conn.Read(buffer)
+
+	c.agent.download.Wait(n)
+	c.tunnel.download.Wait(n)
+
+	if quotaErr := c.account(n, true); quotaErr != nil && err == nil {
+		err = quotaErr
+	}
+
+	return n, err
+}
+
+func (c *meteredConnection) account(n int, download bool) error {
+	if n <= 0 {
+		return nil
+	}
+
+	agentErr := c.agent.add(n, download)
+	if err := c.tunnel.add(n, download); err != nil {
+		return err
+	}
+
+	return agentErr
+}
@@ -0,0 +1,91 @@
+package traffic
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tunnel-transporter/config/server"
+)
+
+func TestQuota(t *testing.T) {
+	directory, err := ioutil.TempDir("", "traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	config := server.Traffic{
+		StatePath: filepath.Join(directory, "state.json"),
+		Agents: map[string]server.AgentTraffic{
+			"ABC": {Tunnels: map[string]server.TrafficPolicy{"web": {Quota: 10, QuotaPeriod: server.DailyPeriod}}},
+		},
+	}
+
+	manager, err := NewTrafficManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		buffer := make([]byte, 64)
+		for {
+			if _, err := remote.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn := manager.Wrap("ABC", "web", local)
+	if _, err = conn.Write(make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = conn.Write(make([]byte, 6)); err == nil {
+		t.Fatal("expected quota to be exhausted")
+	}
+
+	if err = manager.Check("ABC", "web"); err == nil {
+		t.Fatal("expected tunnel to be disabled")
+	}
+
+	if err = manager.Check("ABC", "ssh"); err != nil {
+		t.Fatalf("expected other tunnel to be enabled, got %v", err)
+	}
+
+	if upload, download := manager.Bytes("ABC", "web"); upload != 12 || download != 0 {
+		t.Fatalf("expected 12 bytes uploaded, got %d and %d", upload, download)
+	}
+
+	if err = manager.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewTrafficManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = restored.Check("ABC", "web"); err == nil {
+		t.Fatal("expected quota usage to be restored from state file")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(1000)
+
+	start := time.Now()
+	limiter.Wait(1000)
+	limiter.Wait(500)
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected 500 bytes over the burst to wait about 500ms, waited %s", elapsed)
+	}
+
+	var unlimited *Limiter
+	unlimited.Wait(1 << 20)
+}
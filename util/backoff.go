@@ -0,0 +1,43 @@
+package util
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the delay before a retry, growing by Multiplier from InitialDelay up to
+// MaxDelay, each delay randomly spread by up to Jitter of itself either way.
+type Backoff struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64
+
+	random *rand.Rand
+}
+
+func NewBackoff(initialDelay time.Duration, maxDelay time.Duration, multiplier float64, jitter float64) *Backoff {
+	return &Backoff{
+		InitialDelay: initialDelay,
+		MaxDelay:     maxDelay,
+		Multiplier:   multiplier,
+		Jitter:       jitter,
+		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Delay returns the delay before the given attempt, the first retry being attempt 1.
+func (b *Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.InitialDelay) * math.Pow(b.Multiplier, float64(attempt-1))
+	if delay > float64(b.MaxDelay) {
+		delay = float64(b.MaxDelay)
+	}
+
+	delay += delay * b.Jitter * (2*b.random.Float64() - 1)
+	if delay > float64(b.MaxDelay) {
+		delay = float64(b.MaxDelay)
+	}
+
+	return time.Duration(delay)
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := NewBackoff(time.Second, 10*time.Second, 2, 0)
+	for attempt, expected := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		60: 10 * time.Second,
+	} {
+		if delay := backoff.Delay(attempt); delay != expected {
+			t.Fatalf("expected delay %s of attempt %d, got %s", expected, attempt, delay)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	backoff := NewBackoff(time.Second, 10*time.Second, 2, 0.5)
+	for i := 0; i < 100; i++ {
+		if delay := backoff.Delay(3); delay < 2*time.Second || delay > 6*time.Second {
+			t.Fatalf("delay %s out of jitter range", delay)
+		}
+
+		if delay := backoff.Delay(10); delay < 5*time.Second || delay > 10*time.Second {
+			t.Fatalf("delay %s out of jitter range below max delay", delay)
+		}
+	}
+}
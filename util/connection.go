@@ -1,10 +1,18 @@
 package util
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
+	"github.com/pkg/errors"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"tunnel-transporter/message"
 )
@@ -19,6 +27,27 @@ func Dial(host string, port int) (*net.TCPConn, error) {
 	return conn, err
 }
 
+// DialWithTls dials the address and runs the tls handshake over the connection when
+// tlsConfig is not nil.
+func DialWithTls(host string, port int, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := Dial(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
 func Listen(port int) (*net.TCPListener, error) {
 	addr, _ := net.ResolveTCPAddr("tcp", ":"+strconv.Itoa(port))
 	return net.ListenTCP("tcp", addr)
@@ -28,6 +57,21 @@ func ListenOnRandomPort() (*net.TCPListener, error) {
 	return net.ListenTCP("tcp", nil)
 }
 
+func RandomId() string {
+	buffer := make([]byte, 16)
+	_, _ = rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// NormalizeHost lower-cases the host and strips its port and trailing dot.
+func NormalizeHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
 func ResolveAddress(address string) (string, int) {
 	addr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
@@ -38,24 +82,57 @@ func ResolveAddress(address string) (string, int) {
 }
 
 func Join(to net.Conn, from net.Conn) {
-	var wait sync.WaitGroup
+	JoinCounted(to, from, nil, nil)
+}
 
-	pipe := func(to net.Conn, from net.Conn) {
+// JoinCounted joins both connections like Join, reporting the bytes written to each side
+// to the optional counters as they are copied. It returns the connection whose stream ended
+// first, along with the error ending it, nil when it was closed gracefully.
+func JoinCounted(to net.Conn, from net.Conn, toCounter func(n int), fromCounter func(n int)) (net.Conn, error) {
+	var (
+		wait     sync.WaitGroup
+		once     sync.Once
+		closedBy net.Conn
+		closeErr error
+	)
+
+	pipe := func(to net.Conn, from net.Conn, counter func(n int)) {
 		defer to.Close()
 		defer from.Close()
 		defer wait.Done()
 
-		if _, err := io.Copy(to, from); err != nil {
-			return
+		var writer io.Writer = to
+		if counter != nil {
+			writer = &countingWriter{writer: to, counter: counter}
 		}
+
+		_, err := io.Copy(writer, from)
+		once.Do(func() {
+			closedBy, closeErr = from, err
+		})
 	}
 
 	wait.Add(2)
 
-	go pipe(from, to)
-	go pipe(to, from)
+	go pipe(from, to, fromCounter)
+	go pipe(to, from, toCounter)
 
 	wait.Wait()
+
+	return closedBy, closeErr
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	counter func(n int)
+}
+
+func (c *countingWriter) Write(buffer []byte) (int, error) {
+	n, err := c.writer.Write(buffer)
+	if n > 0 {
+		c.counter(n)
+	}
+	return n, err
 }
 
 func Read(conn net.Conn) (message.TypedMessage, error) {
@@ -65,7 +142,7 @@ func Read(conn net.Conn) (message.TypedMessage, error) {
 	}
 
 	buffer := make([]byte, size)
-	if n, err := conn.Read(buffer); err != nil || int64(n) != size {
+	if _, err := io.ReadFull(conn, buffer); err != nil {
 		return nil, err
 	}
 
@@ -93,3 +170,52 @@ func Write(conn net.Conn, typedMessage message.TypedMessage) error {
 
 	return nil
 }
+
+type prefixConnection struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (p *prefixConnection) Read(buffer []byte) (int, error) {
+	return p.reader.Read(buffer)
+}
+
+// NewPrefixConnection returns a connection that replays prefix before reading from conn,
+// used to hand over bytes already consumed while sniffing the protocol.
+func NewPrefixConnection(conn net.Conn, prefix []byte) net.Conn {
+	return &prefixConnection{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(prefix), conn),
+	}
+}
+
+func LoadCertPool(caCertificatePath string) (*x509.CertPool, error) {
+	caCertBytes, err := ioutil.ReadFile(caCertificatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	certPool := x509.NewCertPool()
+	if ok := certPool.AppendCertsFromPEM(caCertBytes); !ok {
+		return nil, errors.New("error while appending CA certificate to pool")
+	}
+
+	return certPool, nil
+}
+
+// AddressIp returns the ip of a tcp or udp address.
+func AddressIp(addr net.Addr) net.IP {
+	switch address := addr.(type) {
+	case *net.TCPAddr:
+		return address.IP
+	case *net.UDPAddr:
+		return address.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	return net.ParseIP(host)
+}
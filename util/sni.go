@@ -0,0 +1,53 @@
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errClientHelloRead = errors.New("client hello read")
+
+// sniffConnection only lets the tls handshake read from the underlying connection,
+// so nothing is ever sent back to the client while sniffing.
+type sniffConnection struct {
+	reader io.Reader
+}
+
+func (s sniffConnection) Read(buffer []byte) (int, error)    { return s.reader.Read(buffer) }
+func (s sniffConnection) Write(buffer []byte) (int, error)   { return 0, io.ErrClosedPipe }
+func (s sniffConnection) Close() error                       { return nil }
+func (s sniffConnection) LocalAddr() net.Addr                { return nil }
+func (s sniffConnection) RemoteAddr() net.Addr               { return nil }
+func (s sniffConnection) SetDeadline(t time.Time) error      { return nil }
+func (s sniffConnection) SetReadDeadline(t time.Time) error  { return nil }
+func (s sniffConnection) SetWriteDeadline(t time.Time) error { return nil }
+
+// ReadServerName reads the tls ClientHello from conn without terminating tls, and returns
+// the requested SNI server name together with the bytes consumed from conn.
+func ReadServerName(conn net.Conn) (string, []byte, error) {
+	consumed := &bytes.Buffer{}
+	var serverName string
+	var sniffed bool
+
+	err := tls.Server(sniffConnection{reader: io.TeeReader(conn, consumed)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			sniffed = true
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	if !sniffed {
+		return "", consumed.Bytes(), err
+	}
+
+	if serverName == "" {
+		return "", consumed.Bytes(), errors.New("client hello without server name")
+	}
+
+	return NormalizeHost(serverName), consumed.Bytes(), nil
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestReadServerName(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+
+	go func() {
+		_ = tls.Client(clientSide, &tls.Config{ServerName: "App.Example.com"}).Handshake()
+		clientSide.Close()
+	}()
+
+	serverName, consumed, err := ReadServerName(serverSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if serverName != "app.example.com" {
+		t.Fatalf("unexpected server name %s", serverName)
+	}
+
+	if len(consumed) == 0 || consumed[0] != 0x16 {
+		t.Fatal("consumed bytes do not start with a tls handshake record")
+	}
+}
+
+func TestReadServerNameNotTls(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	go func() {
+		_, _ = clientSide.Write(request)
+		clientSide.Close()
+	}()
+
+	if _, consumed, err := ReadServerName(serverSide); err == nil || !bytes.HasPrefix(request, consumed) {
+		t.Fatal("expected error reading server name from plain http request")
+	}
+}
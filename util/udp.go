@@ -0,0 +1,102 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const maxDatagramSize = 65535
+
+func DialUdp(host string, port int) (*net.UDPConn, error) {
+	addr, _ := net.ResolveUDPAddr("udp", host+":"+strconv.Itoa(port))
+	return net.DialUDP("udp", nil, addr)
+}
+
+// ListenUdp listens on the given udp port, or on a random port when port is zero.
+func ListenUdp(port int) (*net.UDPConn, error) {
+	addr, _ := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(port))
+	return net.ListenUDP("udp", addr)
+}
+
+// WriteDatagram frames a datagram with its 2 bytes big endian length, so datagrams
+// can be carried over stream connections. Larger datagrams than the length can tell
+// are refused rather than framed with a wrapped length.
+func WriteDatagram(conn io.Writer, payload []byte) error {
+	if len(payload) > maxDatagramSize {
+		return errors.New(fmt.Sprintf("datagram of %d bytes exceeds %d bytes", len(payload), maxDatagramSize))
+	}
+
+	buffer := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(buffer, uint16(len(payload)))
+	copy(buffer[2:], payload)
+
+	_, err := conn.Write(buffer)
+	return err
+}
+
+func ReadDatagram(conn io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// datagramConnection adapts a connected udp socket to the framed datagram stream
+// carried over tunnel connections, so it can be joined like any tcp connection.
+type datagramConnection struct {
+	net.Conn
+	packet      []byte
+	readBuffer  bytes.Buffer
+	writeBuffer bytes.Buffer
+}
+
+func NewDatagramConnection(conn net.Conn) net.Conn {
+	return &datagramConnection{
+		Conn:   conn,
+		packet: make([]byte, maxDatagramSize),
+	}
+}
+
+func (d *datagramConnection) Read(buffer []byte) (int, error) {
+	if d.readBuffer.Len() == 0 {
+		n, err := d.Conn.Read(d.packet)
+		if err != nil {
+			return 0, err
+		}
+
+		_ = WriteDatagram(&d.readBuffer, d.packet[:n])
+	}
+
+	return d.readBuffer.Read(buffer)
+}
+
+func (d *datagramConnection) Write(buffer []byte) (int, error) {
+	d.writeBuffer.Write(buffer)
+
+	for d.writeBuffer.Len() >= 2 {
+		frame := d.writeBuffer.Bytes()
+		size := int(binary.BigEndian.Uint16(frame))
+		if len(frame) < 2+size {
+			break
+		}
+
+		if _, err := d.Conn.Write(frame[2 : 2+size]); err != nil {
+			return 0, err
+		}
+		d.writeBuffer.Next(2 + size)
+	}
+
+	return len(buffer), nil
+}
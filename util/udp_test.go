@@ -0,0 +1,109 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	payloads := [][]byte{[]byte("ping"), {}, bytes.Repeat([]byte{1}, maxDatagramSize)}
+
+	stream := &bytes.Buffer{}
+	for _, payload := range payloads {
+		if err := WriteDatagram(stream, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, payload := range payloads {
+		read, err := ReadDatagram(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(read, payload) {
+			t.Fatalf("expected datagram of %d bytes, got %d bytes", len(payload), len(read))
+		}
+	}
+
+	if _, err := ReadDatagram(stream); err != io.EOF {
+		t.Fatalf("expected end of stream, got %v", err)
+	}
+}
+
+func TestDatagramFramingErrors(t *testing.T) {
+	if err := WriteDatagram(&bytes.Buffer{}, make([]byte, maxDatagramSize+1)); err == nil {
+		t.Fatal("expected oversized datagram to be refused")
+	}
+
+	cases := []struct {
+		frame []byte
+		err   error
+	}{
+		{[]byte{0}, io.ErrUnexpectedEOF},
+		{[]byte{0, 4, 'p', 'i'}, io.ErrUnexpectedEOF},
+	}
+
+	for _, c := range cases {
+		if _, err := ReadDatagram(bytes.NewReader(c.frame)); err != c.err {
+			t.Fatalf("expected %v reading truncated frame %v, got %v", c.err, c.frame, err)
+		}
+	}
+}
+
+func TestDatagramConnection(t *testing.T) {
+	local, err := ListenUdp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	_, port := ResolveAddress(local.LocalAddr().String())
+	conn, err := DialUdp("127.0.0.1", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagramConnection := NewDatagramConnection(conn)
+	defer datagramConnection.Close()
+
+	// a frame written in pieces is sent as one datagram once complete
+	frame := &bytes.Buffer{}
+	_ = WriteDatagram(frame, []byte("ping"))
+	_ = WriteDatagram(frame, []byte("pong"))
+	for _, piece := range [][]byte{frame.Bytes()[:3], frame.Bytes()[3:]} {
+		if _, err = datagramConnection.Write(piece); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buffer := make([]byte, 64)
+	_ = local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []string{"ping", "pong"} {
+		n, remoteAddr, err := local.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buffer[:n]) != expected {
+			t.Fatalf("expected datagram %s, got %s", expected, buffer[:n])
+		}
+
+		if _, err = local.WriteToUDP([]byte("reply-"+expected), remoteAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_ = datagramConnection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []string{"reply-ping", "reply-pong"} {
+		payload, err := ReadDatagram(datagramConnection)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(payload) != expected {
+			t.Fatalf("expected framed reply %s, got %s", expected, payload)
+		}
+	}
+}
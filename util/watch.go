@@ -0,0 +1,38 @@
+package util
+
+import (
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// WatchFile calls reload every interval the modification time of the file changed since the
+// last check, a failing reload is logged and retried on the next change.
+func WatchFile(path string, interval time.Duration, reload func() error) {
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.WithField("path", path).WithError(err).Error("error checking file")
+			continue
+		}
+
+		if info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+
+		if err = reload(); err != nil {
+			log.WithField("path", path).WithError(err).Error("error reloading file")
+			continue
+		}
+		log.WithField("path", path).Info("reloaded file")
+	}
+}